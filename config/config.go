@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/aerokube/selenoid/egress"
+	"github.com/aerokube/selenoid/protect"
 	"github.com/aerokube/selenoid/session"
 	"github.com/docker/docker/api/types/container"
 	corev1 "k8s.io/api/core/v1"
@@ -23,6 +26,7 @@ type Session struct {
 	Screen        string             `json:"screen"`
 	Caps          session.Caps       `json:"caps"`
 	Started       time.Time          `json:"started"`
+	Stats         *session.Stats     `json:"stats,omitempty"`
 }
 
 // Sessions - used count and individual sessions for quota user
@@ -42,29 +46,141 @@ type Browsers map[string]Version
 
 // State - current state
 type State struct {
-	Total    int      `json:"total"`
-	Used     int      `json:"used"`
-	Queued   int      `json:"queued"`
-	Pending  int      `json:"pending"`
-	Browsers Browsers `json:"browsers"`
+	Total    int                    `json:"total"`
+	Used     int                    `json:"used"`
+	Queued   int                    `json:"queued"`
+	Pending  int                    `json:"pending"`
+	Browsers Browsers               `json:"browsers"`
+	Budget   *protect.BudgetState   `json:"budget,omitempty"`
+	Hosts    []HostState            `json:"hosts,omitempty"`
+	Docker   *DockerState           `json:"docker,omitempty"`
+	Degraded []protect.BreakerState `json:"degraded,omitempty"`
+}
+
+// DockerState - Docker daemon availability
+type DockerState struct {
+	Healthy    bool      `json:"healthy"`
+	APIVersion string    `json:"apiVersion,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// HostState - sessions placed on Docker host
+type HostState struct {
+	Name     string `json:"name"`
+	IP       string `json:"ip,omitempty"`
+	Capacity int    `json:"capacity"`
+	Used     int    `json:"used"`
+	Healthy  bool   `json:"healthy"`
 }
 
 // Browser configuration
 type Browser struct {
-	Image           interface{}       `json:"image"`
-	Port            string            `json:"port"`
-	Path            string            `json:"path"`
-	Tmpfs           map[string]string `json:"tmpfs,omitempty"`
-	Volumes         []string          `json:"volumes,omitempty"`
-	Env             []string          `json:"env,omitempty"`
-	Hosts           []string          `json:"hosts,omitempty"`
-	ShmSize         int64             `json:"shmSize,omitempty"`
-	Labels          map[string]string `json:"labels,omitempty"`
-	Sysctl          map[string]string `json:"sysctl,omitempty"`
-	Mem             string            `json:"mem,omitempty"`
-	Cpu             string            `json:"cpu,omitempty"`
-	PublishAllPorts bool              `json:"publishAllPorts,omitempty"`
-	PodTemplate     *corev1.Pod       `json:"podTemplate,omitempty"`
+	Image           interface{}          `json:"image"`
+	Digest          string               `json:"digest,omitempty"`
+	AllowedImages   []string             `json:"allowedImages,omitempty"`
+	AllowedSidecars []string             `json:"allowedSidecars,omitempty"`
+	Port            string               `json:"port"`
+	Path            string               `json:"path"`
+	Tmpfs           map[string]string    `json:"tmpfs,omitempty"`
+	Volumes         []string             `json:"volumes,omitempty"`
+	Env             []string             `json:"env,omitempty"`
+	Hosts           []string             `json:"hosts,omitempty"`
+	ShmSize         int64                `json:"shmSize,omitempty"`
+	Labels          map[string]string    `json:"labels,omitempty"`
+	Sysctl          map[string]string    `json:"sysctl,omitempty"`
+	Mem             string               `json:"mem,omitempty"`
+	Cpu             string               `json:"cpu,omitempty"`
+	MaxMem          string               `json:"maxMem,omitempty"`
+	MaxCpu          string               `json:"maxCpu,omitempty"`
+	PublishAllPorts bool                 `json:"publishAllPorts,omitempty"`
+	CapAdd          []string             `json:"capAdd,omitempty"`
+	CapDrop         []string             `json:"capDrop,omitempty"`
+	SecurityOpt     []string             `json:"securityOpt,omitempty"`
+	Ulimits         []string             `json:"ulimits,omitempty"`
+	Devices         []string             `json:"devices,omitempty"`
+	User            string               `json:"user,omitempty"`
+	ReadOnlyRootfs  bool                 `json:"readOnlyRootfs,omitempty"`
+	Init            *bool                `json:"init,omitempty"`
+	Runtime         string               `json:"runtime,omitempty"`
+	GroupAdd        []string             `json:"groupAdd,omitempty"`
+	LogConfig       *container.LogConfig `json:"logConfig,omitempty"`
+	SessionNetwork  bool                 `json:"sessionNetwork,omitempty"`
+	Egress          *egress.Policy       `json:"egress,omitempty"`
+	PodTemplate     *corev1.Pod          `json:"podTemplate,omitempty"`
+	Fallback        []string             `json:"fallback,omitempty"`
+	StartupTimeout  string               `json:"startupTimeout,omitempty"`
+	AttemptTimeout  string               `json:"sessionAttemptTimeout,omitempty"`
+	RetryCount      int                  `json:"retryCount,omitempty"`
+	Readiness       *Readiness           `json:"readiness,omitempty"`
+
+	DefaultCapabilities map[string]interface{} `json:"defaultCapabilities,omitempty"`
+	ForcedCapabilities  map[string]interface{} `json:"forcedCapabilities,omitempty"`
+	allowedImages       []*regexp.Regexp
+	allowedSidecars     []*regexp.Regexp
+}
+
+// Readiness - how to determine that started browser accepts new sessions
+type Readiness struct {
+	Path        string `json:"path,omitempty"`
+	Status      int    `json:"status,omitempty"`
+	Ready       bool   `json:"ready,omitempty"`
+	HealthCheck bool   `json:"healthCheck,omitempty"`
+}
+
+// ImageFor - image or command for the given architecture
+func (b *Browser) ImageFor(arch string) (interface{}, bool) {
+	images, ok := b.Image.(map[string]interface{})
+	if !ok {
+		return b.Image, true
+	}
+	image, ok := images[arch]
+	return image, ok && image != nil
+}
+
+// Compile - compile allowed images and sidecars patterns, nothing is allowed until compiled
+func (b *Browser) Compile() error {
+	var err error
+	b.allowedImages, err = compile(b.AllowedImages)
+	if err != nil {
+		return fmt.Errorf("allowed images: %v", err)
+	}
+	b.allowedSidecars, err = compile(b.AllowedSidecars)
+	if err != nil {
+		return fmt.Errorf("allowed sidecars: %v", err)
+	}
+	return nil
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	var ret []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
+
+// AllowsImage - whether image can replace configured one
+func (b *Browser) AllowsImage(image string) bool {
+	return matchesAny(b.allowedImages, image)
+}
+
+// AllowsSidecar - whether image can be started as sidecar container
+func (b *Browser) AllowsSidecar(image string) bool {
+	return matchesAny(b.allowedSidecars, image)
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
 }
 
 // Versions configuration
@@ -79,6 +195,7 @@ type Config struct {
 	LastReloadTime time.Time
 	Browsers       map[string]Versions
 	ContainerLogs  *container.LogConfig
+	Architecture   string
 }
 
 // NewConfig creates new config
@@ -105,6 +222,19 @@ func (config *Config) Load(browsers, containerLogs string) error {
 	if err != nil {
 		return fmt.Errorf("browsers config: %v", err)
 	}
+	for name, versions := range br {
+		for version, browser := range versions.Versions {
+			if browser == nil {
+				continue
+			}
+			if err := browser.Egress.Validate(); err != nil {
+				return fmt.Errorf("browsers config: %s %s: %v", name, version, err)
+			}
+			if err := browser.Compile(); err != nil {
+				return fmt.Errorf("browsers config: %s %s: %v", name, version, err)
+			}
+		}
+	}
 	log.Printf("[-] [INIT] [Loaded configuration from %s]", browsers)
 	cl := &container.LogConfig{}
 	if containerLogs != "" {
@@ -144,14 +274,47 @@ func (config *Config) Find(name string, version string) (*Browser, string, bool)
 	return nil, version, false
 }
 
+// Images - Docker images of all browsers
+func (config *Config) Images() []string {
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+	var ret []string
+	for _, versions := range config.Browsers {
+		for _, browser := range versions.Versions {
+			if browser == nil {
+				continue
+			}
+			if browser.Digest != "" {
+				ret = append(ret, browser.Digest)
+			}
+			switch image := browser.Image.(type) {
+			case string:
+				ret = append(ret, image)
+			case map[string]interface{}:
+				for _, i := range image {
+					if s, ok := i.(string); ok {
+						ret = append(ret, s)
+					}
+				}
+			}
+		}
+	}
+	return ret
+}
+
 // State - get current state
 func (config *Config) State(sessions *session.Map, limit, queued, pending int) *State {
 	config.lock.RLock()
 	defer config.lock.RUnlock()
-	state := &State{limit, 0, queued, pending, make(Browsers)}
+	state := &State{Total: limit, Queued: queued, Pending: pending, Browsers: make(Browsers)}
 	for n, b := range config.Browsers {
 		state.Browsers[n] = make(Version)
-		for v := range b.Versions {
+		for v, browser := range b.Versions {
+			if config.Architecture != "" && browser != nil {
+				if _, ok := browser.ImageFor(config.Architecture); !ok {
+					continue
+				}
+			}
 			state.Browsers[n][v] = make(Quota)
 		}
 	}
@@ -185,6 +348,7 @@ func (config *Config) State(sessions *session.Map, limit, queued, pending int) *
 			Screen:        session.Caps.ScreenResolution,
 			Caps:          session.Caps,
 			Started:       session.Started,
+			Stats:         session.Usage.Stats(),
 		}
 		if ctr != nil {
 			sess.Container = ctr.ID
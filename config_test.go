@@ -124,6 +124,20 @@ func TestConfigNonEmptyVersions(t *testing.T) {
 	assert.Equal(t, state.Browsers["firefox"]["49.0"]["unknown"].Count, 1)
 }
 
+func TestConfigStateHidesOtherArchitectures(t *testing.T) {
+	confFile := configfile(`{"firefox":{"default":"49.0","versions":{"49.0":{"image":{"amd64":"image-amd64","arm64":"image-arm64"}},"48.0":{"image":{"amd64":"image-amd64"}},"47.0":{"image":"image"}}}}`)
+	defer os.Remove(confFile)
+	conf := config.NewConfig()
+	err := conf.Load(confFile, testLogConf)
+	assert.NoError(t, err)
+	conf.Architecture = "arm64"
+
+	state := conf.State(session.NewMap(), 1, 0, 0)
+	assert.Contains(t, state.Browsers["firefox"], "49.0")
+	assert.NotContains(t, state.Browsers["firefox"], "48.0")
+	assert.Contains(t, state.Browsers["firefox"], "47.0")
+}
+
 func TestConfigFindMissingBrowser(t *testing.T) {
 	confFile := configfile(`{}`)
 	defer os.Remove(confFile)
@@ -207,6 +221,36 @@ func TestConfigFindImage(t *testing.T) {
 	assert.Equal(t, b.Path, "/")
 }
 
+func TestConfigAllowedImages(t *testing.T) {
+	confFile := configfile(`{"firefox":{"default":"49.0","versions":{"49.0":{"image":"image","allowedImages":["^registry\\.example\\.com/.+$"],"allowedSidecars":["^wiremock/.+$"]}}}}`)
+	defer os.Remove(confFile)
+	conf := config.NewConfig()
+	err := conf.Load(confFile, testLogConf)
+	assert.NoError(t, err)
+
+	b, _, ok := conf.Find("firefox", "49.0")
+	assert.True(t, ok)
+	assert.True(t, b.AllowsImage("registry.example.com/firefox:49.0"))
+	assert.False(t, b.AllowsImage("evil.example.com/firefox:49.0"))
+	assert.True(t, b.AllowsSidecar("wiremock/wiremock:3.3.1"))
+	assert.False(t, b.AllowsSidecar("evil/image"))
+}
+
+func TestConfigBadAllowedImages(t *testing.T) {
+	confFile := configfile(`{"firefox":{"default":"49.0","versions":{"49.0":{"image":"image","allowedImages":["("]}}}}`)
+	defer os.Remove(confFile)
+	conf := config.NewConfig()
+	err := conf.Load(confFile, testLogConf)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "browsers config: firefox 49.0: allowed images: invalid pattern (")
+
+	confFile = configfile(`{"firefox":{"default":"49.0","versions":{"49.0":{"image":"image","allowedSidecars":["["]}}}}`)
+	defer os.Remove(confFile)
+	err = conf.Load(confFile, testLogConf)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "allowed sidecars: invalid pattern [")
+}
+
 func TestConfigConcurrentLoad(t *testing.T) {
 	confFile := configfile(`{"firefox":{"default":""}}`)
 	defer os.Remove(confFile)
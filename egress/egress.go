@@ -0,0 +1,155 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	AllowAll  = "allow-all"
+	DenyAll   = "deny-all"
+	Allowlist = "allowlist"
+)
+
+// Policy - hosts and networks browser is allowed to connect to
+type Policy struct {
+	Mode  string   `json:"mode"`
+	Allow []string `json:"allow,omitempty"`
+
+	also *Policy
+}
+
+// Intersect - policy allowing only connections allowed by both policies
+func Intersect(p *Policy, other *Policy) *Policy {
+	if !p.Enforced() {
+		return other
+	}
+	if !other.Enforced() || p == other {
+		return p
+	}
+	if p.Mode == DenyAll {
+		return p
+	}
+	if other.Mode == DenyAll {
+		return other
+	}
+	return &Policy{Mode: p.Mode, Allow: p.Allow, also: Intersect(p.also, other)}
+}
+
+// Validate - check policy mode and allowed hosts
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Mode {
+	case AllowAll, DenyAll:
+	case Allowlist:
+		for _, allowed := range p.Allow {
+			if strings.Contains(allowed, "/") {
+				if _, _, err := net.ParseCIDR(allowed); err != nil {
+					return fmt.Errorf("invalid network %s: %v", allowed, err)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported egress mode: %s", p.Mode)
+	}
+	return nil
+}
+
+// Enforced - whether connections should go through egress proxy
+func (p *Policy) Enforced() bool {
+	return p != nil && p.Mode != AllowAll
+}
+
+// Allows - whether connections to host are allowed
+func (p *Policy) Allows(ctx context.Context, host string) bool {
+	_, ok := p.Resolve(ctx, host)
+	return ok
+}
+
+// Resolve - whether connections to host are allowed and addresses checked against allowed networks,
+// connections should only be made to these addresses when they are returned
+func (p *Policy) Resolve(ctx context.Context, host string) ([]net.IP, bool) {
+	ips, ok := p.resolve(ctx, host)
+	if !ok || p == nil || p.also == nil {
+		return ips, ok
+	}
+	allowed, ok := p.also.Resolve(ctx, host)
+	switch {
+	case !ok:
+		return nil, false
+	case ips == nil:
+		return allowed, true
+	case allowed == nil:
+		return ips, true
+	}
+	var both []net.IP
+	for _, ip := range ips {
+		for _, other := range allowed {
+			if ip.Equal(other) {
+				both = append(both, ip)
+				break
+			}
+		}
+	}
+	return both, len(both) > 0
+}
+
+func (p *Policy) resolve(ctx context.Context, host string) ([]net.IP, bool) {
+	if !p.Enforced() {
+		return nil, true
+	}
+	if p.Mode == DenyAll {
+		return nil, false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var networks []*net.IPNet
+	for _, allowed := range p.Allow {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+		if matchesHost(strings.ToLower(allowed), host) {
+			return nil, true
+		}
+	}
+	if len(networks) == 0 {
+		return nil, false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			return nil, false
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !contains(networks, ip) {
+			return nil, false
+		}
+	}
+	return ips, true
+}
+
+func matchesHost(pattern string, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
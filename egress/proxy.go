@@ -0,0 +1,161 @@
+package egress
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy - forward proxy applying egress policies of registered browser containers
+type Proxy struct {
+	lock    sync.RWMutex
+	clients map[string]*Policy
+}
+
+// NewProxy - create egress proxy
+func NewProxy() *Proxy {
+	return &Proxy{clients: make(map[string]*Policy)}
+}
+
+// Register - apply policy to connections from container IP address
+func (p *Proxy) Register(ip string, policy *Policy) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clients[ip] = policy
+}
+
+// Unregister - forget container IP address
+func (p *Proxy) Unregister(ip string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.clients, ip)
+}
+
+func (p *Proxy) policy(ip string) (*Policy, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	policy, ok := p.clients[ip]
+	return policy, ok
+}
+
+// ServeHTTP - forward HTTP requests and CONNECT tunnels allowed by policy
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	host := r.URL.Hostname()
+	if r.Method == http.MethodConnect {
+		host, _, _ = net.SplitHostPort(r.Host)
+	}
+	policy, ok := p.policy(ip)
+	var addrs []net.IP
+	if ok {
+		addrs, ok = policy.Resolve(r.Context(), host)
+	}
+	if !ok {
+		log.Printf("[-] [EGRESS_DENIED] [%s] [%s]", ip, host)
+		http.Error(w, "Connection is not allowed by egress policy", http.StatusForbidden)
+		return
+	}
+	dial := dialer(addrs)
+	if r.Method == http.MethodConnect {
+		tunnel(w, r, dial)
+		return
+	}
+	forward(w, r, dial)
+}
+
+type dialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+// Connections are made to addresses checked by policy instead of resolving host name again
+func dialer(addrs []net.IP) dialFunc {
+	d := &net.Dialer{Timeout: 30 * time.Second}
+	if len(addrs) == 0 {
+		return d.DialContext
+	}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+func tunnel(w http.ResponseWriter, r *http.Request, dial dialFunc) {
+	conn, err := dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		_ = conn.Close()
+		http.Error(w, "Tunneling is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		defer conn.Close()
+		defer client.Close()
+		_, _ = io.Copy(conn, client)
+	}()
+	go func() {
+		defer conn.Close()
+		defer client.Close()
+		_, _ = io.Copy(client, conn)
+	}()
+}
+
+func forward(w http.ResponseWriter, r *http.Request, dial dialFunc) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "Absolute URL is required", http.StatusBadRequest)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	transport := &http.Transport{DialContext: dial, DisableKeepAlives: true}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aerokube/selenoid/egress"
+	"github.com/aerokube/selenoid/policy"
+	"github.com/aerokube/selenoid/service"
+	"github.com/aerokube/selenoid/session"
+	"github.com/docker/docker/client"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestEgressPolicyValidate(t *testing.T) {
+	var p *egress.Policy
+	assert.NoError(t, p.Validate())
+	assert.NoError(t, (&egress.Policy{Mode: egress.DenyAll}).Validate())
+	assert.NoError(t, (&egress.Policy{Mode: egress.Allowlist, Allow: []string{"example.com", "10.0.0.0/8"}}).Validate())
+	assert.Error(t, (&egress.Policy{Mode: "allow-some"}).Validate())
+	assert.Error(t, (&egress.Policy{Mode: egress.Allowlist, Allow: []string{"10.0.0.0/33"}}).Validate())
+}
+
+func TestEgressPolicyAllows(t *testing.T) {
+	ctx := context.Background()
+	var p *egress.Policy
+	assert.False(t, p.Enforced())
+	assert.True(t, p.Allows(ctx, "example.com"))
+
+	p = &egress.Policy{Mode: egress.AllowAll}
+	assert.False(t, p.Enforced())
+	assert.True(t, p.Allows(ctx, "example.com"))
+
+	p = &egress.Policy{Mode: egress.DenyAll}
+	assert.True(t, p.Enforced())
+	assert.False(t, p.Allows(ctx, "example.com"))
+
+	p = &egress.Policy{Mode: egress.Allowlist, Allow: []string{"example.com", "*.test.org", "192.168.0.0/16"}}
+	assert.True(t, p.Allows(ctx, "example.com"))
+	assert.True(t, p.Allows(ctx, "Example.COM."))
+	assert.False(t, p.Allows(ctx, "www.example.com"))
+	assert.True(t, p.Allows(ctx, "api.test.org"))
+	assert.False(t, p.Allows(ctx, "test.org"))
+	assert.True(t, p.Allows(ctx, "192.168.1.10"))
+	assert.False(t, p.Allows(ctx, "10.0.0.1"))
+}
+
+func TestEgressPolicyResolve(t *testing.T) {
+	ctx := context.Background()
+	p := &egress.Policy{Mode: egress.Allowlist, Allow: []string{"example.com", "192.168.0.0/16"}}
+	addrs, ok := p.Resolve(ctx, "192.168.1.10")
+	assert.True(t, ok)
+	assert.Equal(t, addrs, []net.IP{net.ParseIP("192.168.1.10")})
+	addrs, ok = p.Resolve(ctx, "example.com")
+	assert.True(t, ok)
+	assert.Empty(t, addrs)
+	_, ok = p.Resolve(ctx, "10.0.0.1")
+	assert.False(t, ok)
+}
+
+func TestEgressPolicyIntersect(t *testing.T) {
+	ctx := context.Background()
+	allowAll := &egress.Policy{Mode: egress.AllowAll}
+	denyAll := &egress.Policy{Mode: egress.DenyAll}
+	browser := &egress.Policy{Mode: egress.Allowlist, Allow: []string{"example.com", "*.test.org", "192.168.0.0/16"}}
+	user := &egress.Policy{Mode: egress.Allowlist, Allow: []string{"api.test.org", "example.com", "192.168.1.0/24"}}
+
+	assert.Nil(t, egress.Intersect(nil, nil))
+	assert.Equal(t, egress.Intersect(nil, browser), browser)
+	assert.Equal(t, egress.Intersect(browser, allowAll), browser)
+	assert.Equal(t, egress.Intersect(browser, denyAll), denyAll)
+	assert.Equal(t, egress.Intersect(denyAll, user), denyAll)
+
+	p := egress.Intersect(browser, user)
+	assert.True(t, p.Enforced())
+	assert.True(t, p.Allows(ctx, "example.com"))
+	assert.True(t, p.Allows(ctx, "api.test.org"))
+	assert.False(t, p.Allows(ctx, "www.test.org"))
+	assert.False(t, p.Allows(ctx, "192.168.2.10"))
+	addrs, ok := p.Resolve(ctx, "192.168.1.10")
+	assert.True(t, ok)
+	assert.Equal(t, addrs, []net.IP{net.ParseIP("192.168.1.10")})
+}
+
+func TestEgressProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	proxy := egress.NewProxy()
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := httpClient.Get(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	proxy.Register("127.0.0.1", &egress.Policy{Mode: egress.Allowlist, Allow: []string{"127.0.0.0/8"}})
+	resp, err = httpClient.Get(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	proxy.Register("127.0.0.1", &egress.Policy{Mode: egress.Allowlist, Allow: []string{"example.com"}})
+	resp, err = httpClient.Get(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+	proxy.Unregister("127.0.0.1")
+	resp, err = httpClient.Get(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+}
+
+func TestEgressProxyTunnel(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	proxy := egress.NewProxy()
+	proxy.Register("127.0.0.1", &egress.Policy{Mode: egress.Allowlist, Allow: []string{"127.0.0.1"}})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	transport := backend.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyUrl)
+	httpClient := &http.Client{Transport: transport}
+
+	resp, err := httpClient.Get(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestEgressPolicyForQuota(t *testing.T) {
+	policyFile := configfile(`{"default": {}, "egress": {"guest": {"mode": "deny-all"}}}`)
+	defer os.Remove(policyFile)
+	p := &policy.Policy{}
+	assert.NoError(t, p.Load(policyFile))
+	assert.Equal(t, p.EgressFor("guest").Mode, egress.DenyAll)
+	assert.Nil(t, p.EgressFor("admin"))
+
+	badPolicyFile := configfile(`{"default": {}, "egress": {"guest": {"mode": "unknown"}}}`)
+	defer os.Remove(badPolicyFile)
+	assert.Error(t, p.Load(badPolicyFile))
+}
+
+func TestEgressPolicyEnforced(t *testing.T) {
+	env := testEnvironment()
+	env.InDocker = true
+	env.EgressNetwork = "egress"
+	env.EgressProxyAddr = "selenoid:4445"
+	env.EgressProxy = egress.NewProxy()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].Egress = &egress.Policy{Mode: egress.DenyAll}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+	createdLock.Lock()
+	networkRequests = nil
+	createdLock.Unlock()
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	assert.Equal(t, startedService.Proxy, "selenoid:4445")
+	assert.Contains(t, lastCreatedContainer().Env, "HTTP_PROXY=http://selenoid:4445")
+	startedService.Cancel()
+
+	createdLock.Lock()
+	var connected []string
+	for _, request := range networkRequests {
+		if strings.HasSuffix(request, "/connect") {
+			connected = append(connected, request)
+		}
+	}
+	createdLock.Unlock()
+	assert.Equal(t, connected, []string{"POST egress/connect"})
+
+	starter, ok = manager.Find(session.Caps{Name: "firefox", Version: "33.0", Egress: &egress.Policy{Mode: egress.AllowAll}}, 42)
+	assert.True(t, ok)
+	startedService, err = starter.StartWithCancel()
+	assert.NoError(t, err)
+	assert.Equal(t, startedService.Proxy, "selenoid:4445")
+	startedService.Cancel()
+
+	env.EgressNetwork = ""
+	starter, ok = manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+}
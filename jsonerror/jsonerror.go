@@ -36,6 +36,10 @@ func SessionNotCreated(err error) *SeleniumError {
 	return newSeleniumError("session not created", err, http.StatusInternalServerError)
 }
 
+func UnsupportedOperation(err error) *SeleniumError {
+	return newSeleniumError("unsupported operation", err, http.StatusInternalServerError)
+}
+
 func UnknownError(err error) *SeleniumError {
 	return newSeleniumError("unknown error", err, http.StatusInternalServerError)
 }
@@ -14,6 +14,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -21,7 +22,9 @@ import (
 
 	ggr "github.com/aerokube/ggr/config"
 	"github.com/aerokube/selenoid/config"
+	"github.com/aerokube/selenoid/egress"
 	"github.com/aerokube/selenoid/jsonerror"
+	"github.com/aerokube/selenoid/policy"
 	"github.com/aerokube/selenoid/protect"
 	"github.com/aerokube/selenoid/service"
 	"github.com/aerokube/selenoid/session"
@@ -31,6 +34,12 @@ import (
 	"golang.org/x/net/websocket"
 )
 
+const (
+	dockerCheckInterval          = 10 * time.Second
+	egressProxyReadHeaderTimeout = 10 * time.Second
+	egressProxyIdleTimeout       = 2 * time.Minute
+)
+
 var (
 	hostname                 string
 	disableDocker            bool
@@ -45,10 +54,13 @@ var (
 	gracefulPeriod           time.Duration
 	limit                    int
 	retryCount               int
+	startupRetryCount        int
+	startupRetryDelay        time.Duration
 	containerNetwork         string
 	sessions                 = session.NewMap()
 	confPath                 string
 	logConfPath              string
+	policyPath               string
 	captureDriverLogs        bool
 	disablePrivileged        bool
 	videoOutputDir           string
@@ -58,9 +70,27 @@ var (
 	kubernetesNamespace      string
 	ggrHost                  *ggr.Host
 	conf                     *config.Config
+	capsPolicy               *policy.Policy
 	queue                    *protect.Queue
+	budget                   *protect.Budget
+	breaker                  *protect.Breaker
+	breakerFailures          int
+	breakerCoolDown          time.Duration
+	egressNetwork            string
+	egressProxyListen        string
+	resourceAdmission        bool
+	totalMem                 service.MemLimit
+	totalCpu                 service.CpuLimit
+	dockerHostsPath          string
 	manager                  service.Manager
 	cli                      *client.Client
+	hosts                    *service.Hosts
+	dockerHealth             *service.DockerHealth
+	imageGCPattern           string
+	imageGCDays              int
+	imageGCInterval          time.Duration
+	imageGCDryRun            bool
+	imageCollector           *service.ImageCollector
 
 	startTime = time.Now()
 
@@ -78,8 +108,11 @@ func init() {
 	flag.StringVar(&listen, "listen", ":4444", "Network address to accept connections")
 	flag.StringVar(&confPath, "conf", "config/browsers.json", "Browsers configuration file")
 	flag.StringVar(&logConfPath, "log-conf", "", "Container logging configuration file")
+	flag.StringVar(&policyPath, "capabilities-policy", "", "Capabilities policy file")
 	flag.IntVar(&limit, "limit", 5, "Simultaneous container runs")
 	flag.IntVar(&retryCount, "retry-count", 1, "New session attempts retry count")
+	flag.IntVar(&startupRetryCount, "startup-retry-count", 0, "Service startup retries on a fresh container or driver process")
+	flag.DurationVar(&startupRetryDelay, "startup-retry-delay", 1*time.Second, "Delay before the first service startup retry in time.Duration format, doubled after every retry up to 30s")
 	flag.DurationVar(&timeout, "timeout", 60*time.Second, "Session idle timeout in time.Duration format")
 	flag.DurationVar(&maxTimeout, "max-timeout", 1*time.Hour, "Maximum valid session idle timeout in time.Duration format")
 	flag.DurationVar(&newSessionAttemptTimeout, "session-attempt-timeout", 30*time.Second, "New session attempt timeout in time.Duration format")
@@ -88,6 +121,18 @@ func init() {
 	flag.BoolVar(&version, "version", false, "Show version and exit")
 	flag.Var(&mem, "mem", "Containers memory limit e.g. 128m or 1g")
 	flag.Var(&cpu, "cpu", "Containers cpu limit as float e.g. 0.2 or 1.0")
+	flag.BoolVar(&resourceAdmission, "resource-admission", false, "Whether to admit sessions by available memory and CPU")
+	flag.Var(&totalMem, "total-mem", "Memory available to containers when admitting by resources e.g. 16g, Docker host memory by default")
+	flag.Var(&totalCpu, "total-cpu", "CPU available to containers when admitting by resources e.g. 8.0, Docker host CPUs by default")
+	flag.IntVar(&breakerFailures, "breaker-failures", 0, "Consecutive startup failures after which browser version is degraded, 0 to disable")
+	flag.DurationVar(&breakerCoolDown, "breaker-cool-down", 1*time.Minute, "Time degraded browser version is not started in time.Duration format")
+	flag.StringVar(&egressNetwork, "egress-network", "", "Internal Docker network Selenoid is connected to for enforcing egress policies")
+	flag.StringVar(&egressProxyListen, "egress-proxy-listen", ":4445", "Network address egress proxy accepts connections from browsers on")
+	flag.StringVar(&dockerHostsPath, "docker-hosts", "", "Docker hosts file to distribute browser containers across")
+	flag.StringVar(&imageGCPattern, "image-gc-pattern", "", "Periodically remove unused images with names matching this regular expression")
+	flag.IntVar(&imageGCDays, "image-gc-days", 7, "Remove unused images older than this number of days")
+	flag.DurationVar(&imageGCInterval, "image-gc-interval", 1*time.Hour, "Unused images removal interval in time.Duration format")
+	flag.BoolVar(&imageGCDryRun, "image-gc-dry-run", false, "Only log unused images instead of removing them")
 	flag.StringVar(&containerNetwork, "container-network", service.DefaultContainerNetwork, "Network to be used for containers")
 	flag.BoolVar(&captureDriverLogs, "capture-driver-logs", false, "Whether to add driver process logs to Selenoid output")
 	flag.BoolVar(&disablePrivileged, "disable-privileged", false, "Whether to disable privileged container mode")
@@ -113,16 +158,35 @@ func init() {
 		ggrHost = parseGgrHost(ggrHostEnv)
 	}
 	queue = protect.New(limit, disableQueue)
+	if breakerFailures > 0 {
+		breaker = protect.NewBreaker(breakerFailures, breakerCoolDown)
+		log.Printf("[-] [INIT] [Degrading browser versions after %d consecutive startup failures for %v]", breakerFailures, breakerCoolDown)
+	}
 	conf = config.NewConfig()
 	err = conf.Load(confPath, logConfPath)
 	if err != nil {
 		log.Fatalf("[-] [INIT] [%s: %v]", os.Args[0], err)
 	}
+	if policyPath != "" {
+		capsPolicy = &policy.Policy{}
+		err = capsPolicy.Load(policyPath)
+		if err != nil {
+			log.Fatalf("[-] [INIT] [%s: capabilities policy: %v]", os.Args[0], err)
+		}
+		log.Printf("[-] [INIT] [Loaded capabilities policy from %s]", policyPath)
+	}
 	onSIGHUP(func() {
 		err := conf.Load(confPath, logConfPath)
 		if err != nil {
 			log.Printf("[-] [INIT] [%s: %v]", os.Args[0], err)
 		}
+		if capsPolicy != nil {
+			err = capsPolicy.Load(policyPath)
+			if err != nil {
+				log.Printf("[-] [INIT] [%s: capabilities policy: %v]", os.Args[0], err)
+			}
+		}
+		go collectImages()
 	})
 	inDocker := false
 	_, err = os.Stat("/.dockerenv")
@@ -163,7 +227,10 @@ func init() {
 		CPU:                  int64(cpu),
 		Memory:               int64(mem),
 		Network:              containerNetwork,
+		Hostname:             hostname,
 		StartupTimeout:       serviceStartupTimeout,
+		AttemptTimeout:       newSessionAttemptTimeout,
+		RetryCount:           retryCount,
 		SessionDeleteTimeout: sessionDeleteTimeout,
 		CaptureDriverLogs:    captureDriverLogs,
 		VideoOutputDir:       videoOutputDir,
@@ -173,37 +240,163 @@ func init() {
 		Privileged:           !disablePrivileged,
 	}
 	if disableDocker {
-		manager = &service.DefaultManager{Environment: &environment, Config: conf}
+		m := &service.DefaultManager{Environment: &environment, Config: conf}
+		conf.Architecture = m.Architecture()
+		manager = m
 		if logOutputDir != "" && captureDriverLogs {
 			log.Fatalf("[-] [INIT] [In drivers mode only one of -capture-driver-logs and -log-output-dir flags is allowed]")
 		}
 		return
 	}
-	dockerHost := os.Getenv("DOCKER_HOST")
-	if dockerHost == "" {
-		dockerHost = client.DefaultDockerHost
+	if egressNetwork != "" {
+		_, egressProxyPort, err := net.SplitHostPort(egressProxyListen)
+		if err != nil {
+			log.Fatalf("[-] [INIT] [Invalid egress proxy address %s: %v]", egressProxyListen, err)
+		}
+		environment.EgressNetwork = egressNetwork
+		environment.EgressProxyAddr = net.JoinHostPort(hostname, egressProxyPort)
+		environment.EgressProxy = egress.NewProxy()
+		go func() {
+			log.Printf("[-] [INIT] [Egress proxy listening on %s in network %s]", egressProxyListen, egressNetwork)
+			proxy := &http.Server{
+				Addr:              egressProxyListen,
+				Handler:           environment.EgressProxy,
+				ReadHeaderTimeout: egressProxyReadHeaderTimeout,
+				IdleTimeout:       egressProxyIdleTimeout,
+			}
+			err := proxy.ListenAndServe()
+			log.Fatalf("[-] [INIT] [Failed to start egress proxy: %v]", err)
+		}()
 	}
-	u, err := client.ParseHostURL(dockerHost)
-	if err != nil {
-		log.Fatalf("[-] [INIT] [%v]", err)
-	}
-	ip, _, _ := net.SplitHostPort(u.Host)
-	environment.IP = ip
-	cli, err = createCompatibleDockerClient(
-		func(specifiedApiVersion string) {
-			log.Printf("[-] [INIT] [Using Docker API version: %s]", specifiedApiVersion)
-		},
-		func(determinedApiVersion string) {
-			log.Printf("[-] [INIT] [Your Docker API version is %s]", determinedApiVersion)
-		},
-		func(defaultApiVersion string) {
-			log.Printf("[-] [INIT] [Did not manage to determine your Docker API version - using default version: %s]", defaultApiVersion)
-		},
-	)
-	if err != nil {
-		log.Fatalf("[-] [INIT] [New docker client: %v]", err)
+	if dockerHostsPath != "" {
+		hosts, err = service.LoadHosts(dockerHostsPath)
+		if err != nil {
+			log.Fatalf("[-] [INIT] [Failed to load Docker hosts from %s: %v]", dockerHostsPath, err)
+		}
+		if _, err := hosts.Architecture(); err != nil {
+			log.Fatalf("[-] [INIT] [Docker hosts from %s: %v]", dockerHostsPath, err)
+		}
+		go hosts.Watch(context.Background(), dockerCheckInterval)
+		cli = hosts.Default()
+		log.Printf("[-] [INIT] [Distributing browser containers across %d Docker hosts from %s]", len(hosts.Clients()), dockerHostsPath)
+	} else {
+		dockerHost := os.Getenv("DOCKER_HOST")
+		if dockerHost == "" {
+			dockerHost = client.DefaultDockerHost
+		}
+		u, err := client.ParseHostURL(dockerHost)
+		if err != nil {
+			log.Fatalf("[-] [INIT] [%v]", err)
+		}
+		ip, _, _ := net.SplitHostPort(u.Host)
+		environment.IP = ip
+		cli, err = createCompatibleDockerClient(
+			func(specifiedApiVersion string) {
+				log.Printf("[-] [INIT] [Using Docker API version: %s]", specifiedApiVersion)
+			},
+			func(determinedApiVersion string) {
+				log.Printf("[-] [INIT] [Your Docker API version is %s]", determinedApiVersion)
+			},
+			func(defaultApiVersion string) {
+				log.Printf("[-] [INIT] [Did not manage to determine your Docker API version - using default version: %s]", defaultApiVersion)
+			},
+		)
+		if err != nil {
+			log.Fatalf("[-] [INIT] [New docker client: %v]", err)
+		}
+		dockerHealth = service.NewDockerHealth(cli, func() (*client.Client, error) {
+			return createCompatibleDockerClient(func(string) {}, func(string) {}, func(string) {})
+		})
+	}
+	clients := []*client.Client{cli}
+	if hosts != nil {
+		clients = hosts.Clients()
+	}
+	if egressNetwork != "" {
+		for _, cl := range clients {
+			err := service.CheckEgressNetwork(context.Background(), cl, egressNetwork)
+			if err != nil {
+				log.Fatalf("[-] [INIT] [Invalid egress network: %v]", err)
+			}
+		}
+	}
+	if resourceAdmission {
+		budget = protect.NewBudget(getTotalResources(clients...))
+		log.Printf("[-] [INIT] [Admitting sessions by resources: %s memory, %s CPU]", totalMem.String(), totalCpu.String())
+	}
+	m := &service.DefaultManager{Environment: &environment, Client: cli, Hosts: hosts, Health: dockerHealth, Config: conf}
+	conf.Architecture = m.Architecture()
+	log.Printf("[-] [INIT] [Browsers architecture: %s]", conf.Architecture)
+	if imageGCPattern != "" {
+		pattern, err := regexp.Compile(imageGCPattern)
+		if err != nil {
+			log.Fatalf("[-] [INIT] [Invalid image garbage collection pattern %s: %v]", imageGCPattern, err)
+		}
+		imageCollector = &service.ImageCollector{
+			Config:  conf,
+			Pattern: pattern,
+			MaxAge:  time.Duration(imageGCDays) * 24 * time.Hour,
+			DryRun:  imageGCDryRun,
+			InUse:   imagesInUse,
+		}
+		log.Printf("[-] [INIT] [Removing unused images matching %s older than %d days every %v, dry run: %t]", imageGCPattern, imageGCDays, imageGCInterval, imageGCDryRun)
+	}
+	manager = m
+}
+
+func getTotalResources(clients ...*client.Client) protect.Resources {
+	if totalMem == 0 || totalCpu == 0 {
+		var mem, cpu int64
+		for _, cl := range clients {
+			dockerInfo, err := cl.Info(context.Background())
+			if err != nil {
+				log.Fatalf("[-] [INIT] [Failed to determine Docker host resources: %v]", err)
+			}
+			mem += dockerInfo.MemTotal
+			cpu += int64(dockerInfo.NCPU) * 1000000000
+		}
+		if totalMem == 0 {
+			totalMem = service.MemLimit(mem)
+		}
+		if totalCpu == 0 {
+			totalCpu = service.CpuLimit(cpu)
+		}
+	}
+	return protect.Resources{Mem: int64(totalMem), CPU: int64(totalCpu)}
+}
+
+func dockerClient() *client.Client {
+	if dockerHealth != nil {
+		return dockerHealth.Client()
+	}
+	return cli
+}
+
+func imagesInUse() []string {
+	images := []string{videoRecorderImage}
+	sessions.Each(func(_ string, s *session.Session) {
+		if s.Container != nil {
+			images = append(images, s.Container.Image)
+		}
+		for _, sidecar := range s.Caps.Sidecars {
+			images = append(images, sidecar.Image)
+		}
+	})
+	return images
+}
+
+func collectImages() {
+	if imageCollector == nil {
+		return
 	}
-	manager = &service.DefaultManager{Environment: &environment, Client: cli, Config: conf}
+	ctx := context.Background()
+	if hosts != nil {
+		for _, cl := range hosts.Clients() {
+			imageCollector.Collect(ctx, cl)
+		}
+		return
+	}
+	imageCollector.Collect(ctx, dockerClient())
 }
 
 func createCompatibleDockerClient(onVersionSpecified, onVersionDetermined, onUsingDefaultVersion func(string)) (*client.Client, error) {
@@ -217,8 +410,7 @@ func createCompatibleDockerClient(onVersionSpecified, onVersionDetermined, onUsi
 		for majorVersion := maxMajorVersion; majorVersion >= minMajorVersion; majorVersion-- {
 			for minorVersion := maxMinorVersion; minorVersion >= minMinorVersion; minorVersion-- {
 				apiVersion := fmt.Sprintf("%d.%d", majorVersion, minorVersion)
-				_ = os.Setenv(dockerApiVersion, apiVersion)
-				docker, err := client.NewClientWithOpts(client.FromEnv)
+				docker, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(apiVersion))
 				if err != nil {
 					return nil, err
 				}
@@ -230,6 +422,7 @@ func createCompatibleDockerClient(onVersionSpecified, onVersionDetermined, onUsi
 			}
 		}
 		onUsingDefaultVersion(api.DefaultVersion)
+		return client.NewClientWithOpts(client.FromEnv, client.WithVersion(api.DefaultVersion))
 	}
 	return client.NewClientWithOpts(client.FromEnv)
 }
@@ -275,7 +468,7 @@ func parseGgrHost(s string) *ggr.Host {
 }
 
 func onSIGHUP(fn func()) {
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP)
 	go func() {
 		for {
@@ -314,11 +507,12 @@ func post(next http.HandlerFunc) http.HandlerFunc {
 func ping(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(struct {
-		Uptime         string `json:"uptime"`
-		LastReloadTime string `json:"lastReloadTime"`
-		NumRequests    uint64 `json:"numRequests"`
-		Version        string `json:"version"`
-	}{time.Since(startTime).String(), conf.LastReloadTime.Format(time.RFC3339), getSerial(), gitRevision})
+		Uptime         string              `json:"uptime"`
+		LastReloadTime string              `json:"lastReloadTime"`
+		NumRequests    uint64              `json:"numRequests"`
+		Version        string              `json:"version"`
+		Docker         *config.DockerState `json:"docker,omitempty"`
+	}{time.Since(startTime).String(), conf.LastReloadTime.Format(time.RFC3339), getSerial(), gitRevision, dockerHealth.State()})
 }
 
 func video(w http.ResponseWriter, r *http.Request) {
@@ -355,7 +549,7 @@ func deleteFileIfExists(requestId uint64, w http.ResponseWriter, r *http.Request
 }
 
 var paths = struct {
-	Video, VNC, Logs, Devtools, Download, Clipboard, File, Ping, Status, Error, WdHub, Welcome string
+	Video, VNC, Logs, Devtools, Download, Clipboard, Network, File, Ping, Status, Error, WdHub, Welcome string
 }{
 	Video:     "/video/",
 	VNC:       "/vnc/",
@@ -363,6 +557,7 @@ var paths = struct {
 	Devtools:  "/devtools/",
 	Download:  "/download/",
 	Clipboard: "/clipboard/",
+	Network:   "/network/",
 	Status:    "/status",
 	File:      "/file",
 	Ping:      "/ping",
@@ -381,11 +576,20 @@ func handler() http.Handler {
 		selenium().ServeHTTP(w, r)
 	})
 	root.HandleFunc(paths.Error, func(w http.ResponseWriter, r *http.Request) {
+		if err := terminatedSessionError(r.URL.Query().Get("session")); err != nil {
+			jsonerror.InvalidSessionID(err).Encode(w)
+			return
+		}
 		jsonerror.InvalidSessionID(errors.New("session timed out or not found")).Encode(w)
 	})
 	root.HandleFunc(paths.Status, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(conf.State(sessions, limit, queue.Queued(), queue.Pending()))
+		state := conf.State(sessions, limit, queue.Queued(), queue.Pending())
+		state.Budget = budget.State()
+		state.Hosts = hosts.State()
+		state.Docker = dockerHealth.State()
+		state.Degraded = breaker.State()
+		_ = json.NewEncoder(w).Encode(state)
 	})
 	root.HandleFunc(paths.Ping, ping)
 	root.Handle(paths.VNC, websocket.Handler(vnc))
@@ -393,6 +597,7 @@ func handler() http.Handler {
 	root.HandleFunc(paths.Video, video)
 	root.HandleFunc(paths.Download, reverseProxy(func(sess *session.Session) string { return sess.HostPort.Fileserver }, "DOWNLOADING_FILE"))
 	root.HandleFunc(paths.Clipboard, reverseProxy(func(sess *session.Session) string { return sess.HostPort.Clipboard }, "CLIPBOARD"))
+	root.HandleFunc(paths.Network, emulateNetwork)
 	root.HandleFunc(paths.Devtools, reverseProxy(func(sess *session.Session) string { return sess.HostPort.Devtools }, "DEVTOOLS"))
 	if enableFileUpload {
 		root.HandleFunc(paths.File, fileUpload)
@@ -410,13 +615,29 @@ func main() {
 	log.Printf("[-] [INIT] [Timezone: %s]", time.Local)
 	log.Printf("[-] [INIT] [Listening on %s]", listen)
 
-	stop := make(chan os.Signal)
+	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
 	server := &http.Server{
 		Addr:    listen,
 		Handler: handler(),
 	}
+	if hosts != nil {
+		for _, cl := range hosts.Clients() {
+			go service.WatchContainers(context.Background(), func() *client.Client { return cl }, onContainerExit)
+		}
+	} else if !disableDocker {
+		go dockerHealth.Watch(context.Background(), dockerCheckInterval)
+		go service.WatchContainers(context.Background(), dockerHealth.Client, onContainerExit)
+	}
+	if imageCollector != nil {
+		go func() {
+			for {
+				collectImages()
+				time.Sleep(imageGCInterval)
+			}
+		}()
+	}
 	e := make(chan error)
 	go func() {
 		e <- server.ListenAndServe()
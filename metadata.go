@@ -32,6 +32,7 @@ func (mp *MetadataProcessor) OnSessionStopped(stoppedSession event.StoppedSessio
 			Started:      stoppedSession.Session.Started,
 			Finished:     time.Now(),
 			Capabilities: stoppedSession.Session.Caps,
+			Stats:        stoppedSession.Session.Usage.Stats(),
 		}
 		data, err := json.MarshalIndent(meta, "", "    ")
 		if err != nil {
@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/aerokube/selenoid/egress"
+	"github.com/aerokube/selenoid/session"
+)
+
+// Rule - value patterns allowed and denied for capability
+type Rule struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// Rules - capability name to rule mapping
+type Rules map[string]*Rule
+
+// Policy - capabilities clients are allowed to request
+type Policy struct {
+	lock    sync.RWMutex
+	Default Rules                     `json:"default"`
+	Quotas  map[string]Rules          `json:"quotas,omitempty"`
+	Egress  map[string]*egress.Policy `json:"egress,omitempty"`
+}
+
+var values = map[string]func(caps session.Caps) []string{
+	"env":                   func(caps session.Caps) []string { return caps.Env },
+	"applicationContainers": func(caps session.Caps) []string { return caps.ApplicationContainers },
+	"additionalNetworks":    func(caps session.Caps) []string { return caps.AdditionalNetworks },
+	"hostsEntries":          func(caps session.Caps) []string { return caps.HostsEntries },
+	"dnsServers":            func(caps session.Caps) []string { return caps.DNSServers },
+	"labels": func(caps session.Caps) []string {
+		var ret []string
+		for k, v := range caps.Labels {
+			ret = append(ret, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(ret)
+		return ret
+	},
+	"containerHostname": func(caps session.Caps) []string {
+		if caps.ContainerHostname == "" {
+			return nil
+		}
+		return []string{caps.ContainerHostname}
+	},
+}
+
+// Load - load policy from file
+func (p *Policy) Load(filename string) error {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read error: %v", err)
+	}
+	var policy Policy
+	if err := json.Unmarshal(buf, &policy); err != nil {
+		return fmt.Errorf("parse error: %v", err)
+	}
+	if err := policy.Default.compile(); err != nil {
+		return err
+	}
+	for quota, rules := range policy.Quotas {
+		if err := rules.compile(); err != nil {
+			return fmt.Errorf("quota %s: %v", quota, err)
+		}
+	}
+	for quota, egressPolicy := range policy.Egress {
+		if err := egressPolicy.Validate(); err != nil {
+			return fmt.Errorf("quota %s egress: %v", quota, err)
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.Default, p.Quotas, p.Egress = policy.Default, policy.Quotas, policy.Egress
+	return nil
+}
+
+func (rules Rules) compile() error {
+	for name, rule := range rules {
+		if _, ok := values[name]; !ok {
+			return fmt.Errorf("unsupported capability: %s", name)
+		}
+		if rule == nil {
+			return fmt.Errorf("empty rule for capability: %s", name)
+		}
+		var err error
+		rule.allow, err = compile(rule.Allow)
+		if err != nil {
+			return fmt.Errorf("capability %s: %v", name, err)
+		}
+		rule.deny, err = compile(rule.Deny)
+		if err != nil {
+			return fmt.Errorf("capability %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	var ret []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
+
+// Check - verify that capabilities requested by quota user are allowed
+func (p *Policy) Check(quota string, caps session.Caps) error {
+	if p == nil {
+		return nil
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	rules := p.Default
+	if quotaRules, ok := p.Quotas[quota]; ok {
+		rules = quotaRules
+	}
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rule := rules[name]
+		for _, value := range values[name](caps) {
+			if !rule.allows(value) {
+				return fmt.Errorf("capability %s value %q is not allowed by policy", name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// EgressFor - egress policy for quota user, nil when not set
+func (p *Policy) EgressFor(quota string) *egress.Policy {
+	if p == nil {
+		return nil
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.Egress[quota]
+}
+
+func (rule *Rule) allows(value string) bool {
+	for _, re := range rule.deny {
+		if re.MatchString(value) {
+			return false
+		}
+	}
+	if len(rule.allow) == 0 {
+		return true
+	}
+	for _, re := range rule.allow {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
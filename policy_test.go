@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aerokube/selenoid/policy"
+	"github.com/aerokube/selenoid/session"
+	assert "github.com/stretchr/testify/require"
+)
+
+const testPolicy = `{
+	"default": {
+		"env": {"allow": ["^LANG=.*$"]},
+		"applicationContainers": {"deny": [".*"]},
+		"labels": {"allow": ["^team="], "deny": ["^team=admin$"]}
+	},
+	"quotas": {
+		"admin": {}
+	}
+}`
+
+func TestPolicyLoadError(t *testing.T) {
+	policyFile := configfile(`{"default": {"unknown": {"deny": [".*"]}}}`)
+	defer os.Remove(policyFile)
+	p := &policy.Policy{}
+	err := p.Load(policyFile)
+	assert.Error(t, err)
+	assert.Equal(t, err.Error(), "unsupported capability: unknown")
+}
+
+func TestPolicyBadPattern(t *testing.T) {
+	policyFile := configfile(`{"default": {"env": {"allow": ["("]}}}`)
+	defer os.Remove(policyFile)
+	p := &policy.Policy{}
+	assert.Error(t, p.Load(policyFile))
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policyFile := configfile(testPolicy)
+	defer os.Remove(policyFile)
+	p := &policy.Policy{}
+	assert.NoError(t, p.Load(policyFile))
+
+	assert.NoError(t, p.Check("unknown", session.Caps{Env: []string{"LANG=en_US.UTF-8"}, Labels: map[string]string{"team": "qa"}}))
+	assert.NoError(t, p.Check("unknown", session.Caps{AdditionalNetworks: []string{"any"}}))
+
+	err := p.Check("unknown", session.Caps{Env: []string{"LANG=en_US.UTF-8", "SECRET=1"}})
+	assert.Error(t, err)
+	assert.Equal(t, err.Error(), `capability env value "SECRET=1" is not allowed by policy`)
+	assert.Error(t, p.Check("unknown", session.Caps{ApplicationContainers: []string{"db"}}))
+	assert.Error(t, p.Check("unknown", session.Caps{Labels: map[string]string{"team": "admin"}}))
+
+	assert.NoError(t, p.Check("admin", session.Caps{ApplicationContainers: []string{"db"}}))
+}
+
+func TestNilPolicyAllowsEverything(t *testing.T) {
+	var p *policy.Policy
+	assert.NoError(t, p.Check("unknown", session.Caps{ApplicationContainers: []string{"db"}}))
+}
+
+func TestSessionNotCreatedOnPolicyViolation(t *testing.T) {
+	policyFile := configfile(testPolicy)
+	defer os.Remove(policyFile)
+	capsPolicy = &policy.Policy{}
+	defer func() {
+		capsPolicy = nil
+	}()
+	assert.NoError(t, capsPolicy.Load(policyFile))
+	manager = &HTTPTest{Handler: Selenium()}
+
+	rsp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"capabilities":{"alwaysMatch":{"browserName":"firefox", "selenoid:options":{"applicationContainers":["db"]}}}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusBadRequest)
+	var e struct {
+		Value map[string]string `json:"value"`
+	}
+	assert.NoError(t, json.NewDecoder(rsp.Body).Decode(&e))
+	assert.Equal(t, e.Value["error"], "invalid argument")
+	assert.Equal(t, e.Value["message"], `capability applicationContainers value "db" is not allowed by policy`)
+	assert.Equal(t, queue.Used(), 0)
+}
@@ -0,0 +1,142 @@
+package protect
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerState - browser version degraded after consecutive startup failures
+type BreakerState struct {
+	Browser  string    `json:"browser"`
+	Version  string    `json:"version"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+	Probing  bool      `json:"probing"`
+}
+
+type breakerKey struct {
+	browser string
+	version string
+}
+
+type breakerEntry struct {
+	failures int
+	until    time.Time
+	probing  bool
+}
+
+// Breaker - rejects browser versions failing to start repeatedly
+// until cool-down period ends and one probe request succeeds
+type Breaker struct {
+	lock      sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	entries   map[breakerKey]*breakerEntry
+}
+
+// NewBreaker - create breaker tripping after threshold consecutive failures
+func NewBreaker(threshold int, coolDown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, coolDown: coolDown, entries: make(map[breakerKey]*breakerEntry)}
+}
+
+func (e *breakerEntry) open() bool {
+	return !e.until.IsZero()
+}
+
+// Allow - check whether browser version can be started, true means that request is a recovery probe
+func (b *Breaker) Allow(browser, version string) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e, ok := b.entries[breakerKey{browser, version}]
+	if !ok || !e.open() {
+		return false, nil
+	}
+	if e.probing {
+		return false, fmt.Errorf("%s %s is degraded after %d consecutive startup failures, recovery probe is in progress", browser, version, e.failures)
+	}
+	if remaining := time.Until(e.until); remaining > 0 {
+		return false, fmt.Errorf("%s %s is degraded after %d consecutive startup failures, retry in %v", browser, version, e.failures, remaining.Round(time.Second))
+	}
+	e.probing = true
+	return true, nil
+}
+
+// Success - browser version started, true means that it has recovered
+func (b *Breaker) Success(browser, version string) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := breakerKey{browser, version}
+	e, ok := b.entries[key]
+	delete(b.entries, key)
+	return ok && e.open()
+}
+
+// Failure - browser version failed to start, true means that it became degraded
+func (b *Breaker) Failure(browser, version string) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := breakerKey{browser, version}
+	e, ok := b.entries[key]
+	if !ok {
+		e = &breakerEntry{}
+		b.entries[key] = e
+	}
+	e.failures++
+	if e.probing || (!e.open() && e.failures >= b.threshold) {
+		e.probing = false
+		e.until = time.Now().Add(b.coolDown)
+		return true
+	}
+	return false
+}
+
+// Abort - browser version start was interrupted before result is known
+func (b *Breaker) Abort(browser, version string) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if e, ok := b.entries[breakerKey{browser, version}]; ok {
+		e.probing = false
+	}
+}
+
+// State - get degraded browser versions
+func (b *Breaker) State() []BreakerState {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var state []BreakerState
+	for key, e := range b.entries {
+		if e.open() {
+			state = append(state, BreakerState{
+				Browser:  key.browser,
+				Version:  key.version,
+				Failures: e.failures,
+				Until:    e.until,
+				Probing:  e.probing,
+			})
+		}
+	}
+	sort.Slice(state, func(i, j int) bool {
+		if state[i].Browser != state[j].Browser {
+			return state[i].Browser < state[j].Browser
+		}
+		return state[i].Version < state[j].Version
+	})
+	return state
+}
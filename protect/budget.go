@@ -0,0 +1,127 @@
+package protect
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Resources - memory in bytes and CPU in nano CPUs
+type Resources struct {
+	Mem int64 `json:"mem"`
+	CPU int64 `json:"cpu"`
+}
+
+// BudgetState - total, used and free resources
+type BudgetState struct {
+	Total   Resources `json:"total"`
+	Used    Resources `json:"used"`
+	Free    Resources `json:"free"`
+	Waiting int       `json:"waiting"`
+}
+
+// Budget - resources reserved by sessions,
+// zero total memory or CPU means that it is not limited
+type Budget struct {
+	lock    sync.Mutex
+	total   Resources
+	used    Resources
+	waiting int
+	changed chan struct{}
+}
+
+// NewBudget - create resources budget
+func NewBudget(total Resources) *Budget {
+	return &Budget{total: total, changed: make(chan struct{})}
+}
+
+// Reserve - wait until requested resources are available and reserve them
+func (b *Budget) Reserve(ctx context.Context, r Resources) error {
+	if b == nil {
+		return nil
+	}
+	if (b.total.Mem > 0 && r.Mem > b.total.Mem) || (b.total.CPU > 0 && r.CPU > b.total.CPU) {
+		return fmt.Errorf("requested resources (mem: %d, cpu: %d) exceed total (mem: %d, cpu: %d)", r.Mem, r.CPU, b.total.Mem, b.total.CPU)
+	}
+	b.lock.Lock()
+	b.waiting++
+	defer func() {
+		b.lock.Lock()
+		b.waiting--
+		b.lock.Unlock()
+	}()
+	for {
+		if b.fits(r) {
+			b.used.Mem += r.Mem
+			b.used.CPU += r.CPU
+			b.lock.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+		b.lock.Lock()
+	}
+}
+
+// TryReserve - reserve requested resources only when they are available right now
+func (b *Budget) TryReserve(r Resources) bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.fits(r) {
+		return false
+	}
+	b.used.Mem += r.Mem
+	b.used.CPU += r.CPU
+	return true
+}
+
+// Share - equal part of total resources for the given number of sessions
+func (b *Budget) Share(sessions int) Resources {
+	if b == nil || sessions <= 0 {
+		return Resources{}
+	}
+	return Resources{Mem: b.total.Mem / int64(sessions), CPU: b.total.CPU / int64(sessions)}
+}
+
+func (b *Budget) fits(r Resources) bool {
+	return (b.total.Mem == 0 || b.used.Mem+r.Mem <= b.total.Mem) &&
+		(b.total.CPU == 0 || b.used.CPU+r.CPU <= b.total.CPU)
+}
+
+// Release - return reserved resources
+func (b *Budget) Release(r Resources) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used.Mem -= r.Mem
+	b.used.CPU -= r.CPU
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// State - get current budget state
+func (b *Budget) State() *BudgetState {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state := &BudgetState{Total: b.total, Used: b.used, Waiting: b.waiting}
+	if b.total.Mem > 0 {
+		state.Free.Mem = b.total.Mem - b.used.Mem
+	}
+	if b.total.CPU > 0 {
+		state.Free.CPU = b.total.CPU - b.used.CPU
+	}
+	return state
+}
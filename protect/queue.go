@@ -81,6 +81,20 @@ func (q *Queue) Protect(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// Yield - give session slot to other requests while waiting for something else
+func (q *Queue) Yield() {
+	q.queued <- struct{}{}
+	<-q.pending
+	<-q.limit
+}
+
+// Resume - wait for session slot given away with Yield
+func (q *Queue) Resume() {
+	q.limit <- struct{}{}
+	q.pending <- struct{}{}
+	<-q.queued
+}
+
 // Used - get created sessions
 func (q *Queue) Used() int {
 	return len(q.used)
@@ -27,9 +27,11 @@ import (
 
 	"github.com/aerokube/selenoid/event"
 	"github.com/aerokube/selenoid/jsonerror"
+	"github.com/aerokube/selenoid/protect"
 	"github.com/aerokube/selenoid/service"
 	"github.com/aerokube/selenoid/session"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/imdario/mergo"
 	"golang.org/x/net/websocket"
@@ -37,6 +39,8 @@ import (
 
 const slash = "/"
 
+const maxStartupRetryDelay = 30 * time.Second
+
 var (
 	httpClient = &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -45,6 +49,9 @@ var (
 	}
 	num     uint64
 	numLock sync.RWMutex
+
+	terminated     = make(map[string]service.ContainerExit)
+	terminatedLock sync.RWMutex
 )
 
 type request struct {
@@ -134,8 +141,17 @@ func create(w http.ResponseWriter, r *http.Request) {
 		queue.Drop()
 		return
 	}
+	var requested struct {
+		Caps    map[string]interface{} `json:"desiredCapabilities"`
+		W3CCaps struct {
+			Caps       map[string]interface{}   `json:"alwaysMatch"`
+			FirstMatch []map[string]interface{} `json:"firstMatch"`
+		} `json:"capabilities"`
+	}
+	_ = json.Unmarshal(body, &requested)
 	if browser.W3CCaps.Caps.BrowserName() != "" && browser.Caps.BrowserName() == "" {
 		browser.Caps = browser.W3CCaps.Caps
+		requested.Caps = requested.W3CCaps.Caps
 	}
 	firstMatchCaps := browser.W3CCaps.FirstMatch
 	if len(firstMatchCaps) == 0 {
@@ -146,10 +162,54 @@ func create(w http.ResponseWriter, r *http.Request) {
 	var ok bool
 	var sessionTimeout time.Duration
 	var finalVideoName, finalLogName string
-	for _, fmc := range firstMatchCaps {
+	var browserCaps session.Caps
+	var requestedCaps map[string]interface{}
+	for i, fmc := range firstMatchCaps {
 		caps = browser.Caps
 		_ = mergo.Merge(&caps, *fmc)
+		requestedCaps = make(map[string]interface{})
+		session.MergeCapabilities(requestedCaps, requested.Caps, false)
+		if i < len(requested.W3CCaps.FirstMatch) {
+			session.MergeCapabilities(requestedCaps, requested.W3CCaps.FirstMatch[i], false)
+		}
 		caps.ProcessExtensionCapabilities()
+		err = capsPolicy.Check(user, caps)
+		if err != nil {
+			log.Printf("[%d] [CAPABILITY_NOT_ALLOWED] [%s] [%s] [%v]", requestId, user, remote, err)
+			jsonerror.InvalidArgument(err).Encode(w)
+			queue.Drop()
+			return
+		}
+		err = checkCustomImage(caps)
+		if err != nil {
+			log.Printf("[%d] [IMAGE_NOT_ALLOWED] [%s] [%s] [%v]", requestId, user, remote, err)
+			jsonerror.InvalidArgument(err).Encode(w)
+			queue.Drop()
+			return
+		}
+		browserCaps = caps
+		defaultCaps, forcedCaps := browserCapabilities(caps)
+		caps, err = caps.WithCapabilities(requestedCaps, defaultCaps, forcedCaps)
+		if err != nil {
+			log.Printf("[%d] [BAD_BROWSER_CAPABILITIES] [%s] [%s] [%v]", requestId, caps.BrowserName(), caps.Version, err)
+			jsonerror.InvalidArgument(err).Encode(w)
+			queue.Drop()
+			return
+		}
+		err = caps.Network.Validate()
+		if err != nil {
+			log.Printf("[%d] [BAD_NETWORK_CONDITIONS] [%v]", requestId, err)
+			jsonerror.InvalidArgument(err).Encode(w)
+			queue.Drop()
+			return
+		}
+		err = service.CheckRequestedResources(caps)
+		if err != nil {
+			log.Printf("[%d] [BAD_RESOURCES] [%v]", requestId, err)
+			jsonerror.InvalidArgument(err).Encode(w)
+			queue.Drop()
+			return
+		}
 		sessionTimeout, err = getSessionTimeout(caps.SessionTimeout, maxTimeout, timeout)
 		if err != nil {
 			log.Printf("[%d] [BAD_SESSION_TIMEOUT] [%s]", requestId, caps.SessionTimeout)
@@ -181,6 +241,7 @@ func create(w http.ResponseWriter, r *http.Request) {
 		if logOutputDir != "" && (saveAllLogs || caps.Log) {
 			caps.LogName = getTemporaryFileName(logOutputDir, logFileExtension)
 		}
+		caps.Egress = capsPolicy.EgressFor(user)
 		starter, ok = manager.Find(caps, requestId)
 		if ok {
 			break
@@ -192,32 +253,62 @@ func create(w http.ResponseWriter, r *http.Request) {
 		queue.Drop()
 		return
 	}
-	startedService, err := starter.StartWithCancel()
+	requestedVersion := caps.Version
+	preparedCaps := caps
+	fallbackCaps := func(version string) (session.Caps, error) {
+		return versionCapabilities(browserCaps, requestedCaps, preparedCaps, version)
+	}
+	startedService, caps, err := startWithFallback(r.Context(), starter, caps, fallbackCaps, requestId)
 	if err != nil {
-		log.Printf("[%d] [SERVICE_STARTUP_FAILED] [%v]", requestId, err)
-		jsonerror.SessionNotCreated(err).Encode(w)
+		if r.Context().Err() != nil {
+			log.Printf("[%d] [CLIENT_DISCONNECTED] [%s] [%s] [%.2fs]", requestId, user, remote, info.SecondsSince(sessionStartTime))
+		} else {
+			jsonerror.SessionNotCreated(err).Encode(w)
+		}
 		queue.Drop()
 		return
 	}
+	defaultCaps, forcedCaps := browserCapabilities(caps)
+	body = applyCapabilities(body, defaultCaps, forcedCaps)
+	if startedService.Proxy != "" {
+		body = applyCapabilities(body, nil, map[string]interface{}{
+			"proxy": map[string]interface{}{
+				"proxyType": "manual",
+				"httpProxy": startedService.Proxy,
+				"sslProxy":  startedService.Proxy,
+			},
+		})
+	}
 	u := startedService.Url
 	cancel := startedService.Cancel
 	host := "localhost"
 	if startedService.Origin != "" {
 		host = startedService.Origin
 	}
+	attemptTimeout := newSessionAttemptTimeout
+	if startedService.AttemptTimeout > 0 {
+		attemptTimeout = startedService.AttemptTimeout
+	}
+	attempts := retryCount
+	if startedService.RetryCount > 0 {
+		attempts = startedService.RetryCount
+	}
 
 	var resp *http.Response
 	i := 1
 	for ; ; i++ {
 		r.URL.Host, r.URL.Path = u.Host, path.Join(u.Path, r.URL.Path)
 		newBody := removeSelenoidOptions(body)
+		if caps.Version != requestedVersion {
+			newBody = replaceBrowserVersion(newBody, caps.Version)
+		}
 		req, _ := http.NewRequest(http.MethodPost, r.URL.String(), bytes.NewReader(newBody))
 		contentType := r.Header.Get("Content-Type")
 		if len(contentType) > 0 {
 			req.Header.Set("Content-Type", contentType)
 		}
 		req.Host = host
-		ctx, done := context.WithTimeout(r.Context(), newSessionAttemptTimeout)
+		ctx, done := context.WithTimeout(r.Context(), attemptTimeout)
 		defer done()
 		log.Printf("[%d] [SESSION_ATTEMPTED] [%s] [%d]", requestId, u.String(), i)
 		rsp, err := httpClient.Do(req.WithContext(ctx))
@@ -228,8 +319,8 @@ func create(w http.ResponseWriter, r *http.Request) {
 			}
 			switch ctx.Err() {
 			case context.DeadlineExceeded:
-				log.Printf("[%d] [SESSION_ATTEMPT_TIMED_OUT] [%s]", requestId, newSessionAttemptTimeout)
-				if i < retryCount {
+				log.Printf("[%d] [SESSION_ATTEMPT_TIMED_OUT] [%s]", requestId, attemptTimeout)
+				if i < attempts {
 					continue
 				}
 				err := fmt.Errorf("New session attempts retry count exceeded")
@@ -291,6 +382,9 @@ func create(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		newBody, sessionId, err := processBody(body, r.Host)
+		if err == nil && caps.Version != requestedVersion {
+			newBody, err = addStartedVersion(newBody, caps.Version)
+		}
 		if err != nil {
 			log.Printf("[%d] [ERROR_PROCESSING_RESPONSE] [%v]", requestId, err)
 			queue.Drop()
@@ -317,6 +411,9 @@ func create(w http.ResponseWriter, r *http.Request) {
 		Container: startedService.Container,
 		HostPort:  startedService.HostPort,
 		Origin:    startedService.Origin,
+		Network:   startedService.Network,
+		Usage:     startedService.Usage,
+		Logs:      startedService.Logs,
 		Timeout:   sessionTimeout,
 		TimeoutCh: onTimeout(sessionTimeout, func() {
 			request{r}.session(s.ID).Delete(requestId)
@@ -370,7 +467,7 @@ func create(w http.ResponseWriter, r *http.Request) {
 				event.FileCreated(createdFile)
 			}
 		}
-		event.SessionStopped(event.StoppedSession{e})
+		event.SessionStopped(event.StoppedSession{Event: e})
 	}
 	sess.Cancel = cancelAndRenameFiles
 	sessions.Put(s.ID, sess)
@@ -378,6 +475,386 @@ func create(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[%d] [SESSION_CREATED] [%s] [%d] [%.2fs]", requestId, s.ID, i, info.SecondsSince(sessionStartTime))
 }
 
+func browserCapabilities(caps session.Caps) (map[string]interface{}, map[string]interface{}) {
+	browser, _, ok := conf.Find(caps.BrowserName(), caps.Version)
+	if !ok {
+		return nil, nil
+	}
+	return browser.DefaultCapabilities, browser.ForcedCapabilities
+}
+
+// Capabilities of fallback version, its default and forced capabilities are applied instead of requested version ones
+func versionCapabilities(requested session.Caps, requestedCaps map[string]interface{}, prepared session.Caps, version string) (session.Caps, error) {
+	requested.Version, requested.W3CVersion = version, ""
+	defaultCaps, forcedCaps := browserCapabilities(requested)
+	caps, err := requested.WithCapabilities(requestedCaps, defaultCaps, forcedCaps)
+	if err != nil {
+		return caps, err
+	}
+	err = caps.Network.Validate()
+	if err != nil {
+		return caps, err
+	}
+	err = service.CheckRequestedResources(caps)
+	if err != nil {
+		return caps, err
+	}
+	caps.ScreenResolution, err = getScreenResolution(caps.ScreenResolution)
+	if err != nil {
+		return caps, err
+	}
+	caps.VideoScreenSize, err = getVideoScreenSize(caps.VideoScreenSize, caps.ScreenResolution)
+	if err != nil {
+		return caps, err
+	}
+	caps.VideoName, caps.LogName, caps.Egress = prepared.VideoName, prepared.LogName, prepared.Egress
+	if caps.Video && !disableDocker && !prepared.Video {
+		caps.VideoName = getTemporaryFileName(videoOutputDir, videoFileExtension)
+	}
+	if logOutputDir != "" && caps.Log && !saveAllLogs && !prepared.Log {
+		caps.LogName = getTemporaryFileName(logOutputDir, logFileExtension)
+	}
+	return caps, nil
+}
+
+func checkCustomImage(caps session.Caps) error {
+	if caps.Image == "" {
+		return nil
+	}
+	browser, version, ok := conf.Find(caps.BrowserName(), caps.Version)
+	if !ok {
+		return nil
+	}
+	image, ok := browser.ImageFor(conf.Architecture)
+	if !ok {
+		return nil
+	}
+	return service.CheckCustomImage(browser, image, caps.BrowserName(), version, caps.Image)
+}
+
+var w3cCapabilities = map[string]struct{}{
+	"browserName":               {},
+	"browserVersion":            {},
+	"platformName":              {},
+	"acceptInsecureCerts":       {},
+	"pageLoadStrategy":          {},
+	"proxy":                     {},
+	"setWindowRect":             {},
+	"timeouts":                  {},
+	"strictFileInteractability": {},
+	"unhandledPromptBehavior":   {},
+	"webSocketUrl":              {},
+}
+
+// Selenoid capabilities are not understood by browsers
+var selenoidCapabilities = map[string]struct{}{
+	"selenoid:options":      {},
+	"screenResolution":      {},
+	"skin":                  {},
+	"enableVNC":             {},
+	"enableVideo":           {},
+	"enableLog":             {},
+	"videoName":             {},
+	"videoScreenSize":       {},
+	"videoFrameRate":        {},
+	"videoCodec":            {},
+	"logName":               {},
+	"timeZone":              {},
+	"containerHostname":     {},
+	"env":                   {},
+	"applicationContainers": {},
+	"additionalNetworks":    {},
+	"hostsEntries":          {},
+	"dnsServers":            {},
+	"labels":                {},
+	"sessionTimeout":        {},
+	"s3KeyPattern":          {},
+	"image":                 {},
+	"mem":                   {},
+	"cpu":                   {},
+	"sessionNetwork":        {},
+	"sidecars":              {},
+	"network":               {},
+}
+
+func jsonwpOnly(caps map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for k, v := range caps {
+		if _, ok := selenoidCapabilities[k]; !ok {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+func w3cOnly(caps map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for k, v := range caps {
+		if _, ok := w3cCapabilities[k]; ok || strings.Contains(k, ":") {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+func applyCapabilities(input []byte, defaults, forced map[string]interface{}) []byte {
+	if len(defaults) == 0 && len(forced) == 0 {
+		return input
+	}
+	body := make(map[string]interface{})
+	err := json.Unmarshal(input, &body)
+	if err != nil {
+		return input
+	}
+	if raw, ok := body["desiredCapabilities"]; ok {
+		if dc, ok := raw.(map[string]interface{}); ok {
+			session.MergeCapabilities(dc, jsonwpOnly(defaults), false)
+			session.MergeCapabilities(dc, jsonwpOnly(forced), true)
+		}
+	}
+	if raw, ok := body["capabilities"]; ok {
+		if c, ok := raw.(map[string]interface{}); ok {
+			am, ok := c["alwaysMatch"].(map[string]interface{})
+			if !ok {
+				am = make(map[string]interface{})
+				c["alwaysMatch"] = am
+			}
+			var fm []map[string]interface{}
+			if raw, ok := c["firstMatch"].([]interface{}); ok {
+				for _, raw := range raw {
+					if c, ok := raw.(map[string]interface{}); ok {
+						fm = append(fm, c)
+					}
+				}
+			}
+			mergeW3CCapabilities(am, fm, w3cOnly(defaults), false)
+			mergeW3CCapabilities(am, fm, w3cOnly(forced), true)
+		}
+	}
+	ret, err := json.Marshal(body)
+	if err != nil {
+		return input
+	}
+	return ret
+}
+
+// W3C forbids the same capability in alwaysMatch and firstMatch,
+// so values already present in firstMatch are merged there
+func mergeW3CCapabilities(alwaysMatch map[string]interface{}, firstMatch []map[string]interface{}, caps map[string]interface{}, force bool) {
+	for k, v := range caps {
+		src := map[string]interface{}{k: v}
+		if _, ok := alwaysMatch[k]; !ok {
+			matched := false
+			for _, c := range firstMatch {
+				if _, ok := c[k]; ok {
+					session.MergeCapabilities(c, src, force)
+					matched = true
+				}
+			}
+			if matched {
+				continue
+			}
+		}
+		session.MergeCapabilities(alwaysMatch, src, force)
+	}
+}
+
+func startService(ctx context.Context, starter service.Starter, caps session.Caps, requestId uint64) (*service.StartedService, error) {
+	browserName, version := caps.BrowserName(), resolvedVersion(caps)
+	breaker := breaker
+	if caps.Image != "" {
+		// Custom image failures say nothing about configured browser version
+		breaker = nil
+	}
+	probe, err := breaker.Allow(browserName, version)
+	if err != nil {
+		log.Printf("[%d] [BROWSER_DEGRADED] [%s] [%s] [%v]", requestId, browserName, version, err)
+		return nil, err
+	}
+	if probe {
+		log.Printf("[%d] [BROWSER_RECOVERY_PROBE] [%s] [%s]", requestId, browserName, version)
+	}
+	var reserved protect.Resources
+	if consumer, ok := starter.(service.Consumer); ok && budget != nil {
+		mem, cpu, err := consumer.Resources()
+		if err != nil {
+			breaker.Abort(browserName, version)
+			return nil, err
+		}
+		reserved = protect.Resources{Mem: mem, CPU: cpu}
+		// Containers without limits are charged as if every session took equal part of total resources
+		share := budget.Share(limit)
+		if reserved.Mem == 0 {
+			reserved.Mem = share.Mem
+		}
+		if reserved.CPU == 0 {
+			reserved.CPU = share.CPU
+		}
+		log.Printf("[%d] [RESERVING_RESOURCES] [%d] [%d]", requestId, reserved.Mem, reserved.CPU)
+		if !budget.TryReserve(reserved) {
+			// Session slot is given to other requests while waiting
+			queue.Yield()
+			err = budget.Reserve(ctx, reserved)
+			queue.Resume()
+			if err != nil {
+				breaker.Abort(browserName, version)
+				return nil, fmt.Errorf("reserve resources: %v", err)
+			}
+		}
+		log.Printf("[%d] [RESOURCES_RESERVED] [%d] [%d]", requestId, reserved.Mem, reserved.CPU)
+	}
+	startedService, err := startWithRetries(ctx, starter, requestId)
+	if err != nil {
+		budget.Release(reserved)
+		if ctx.Err() != nil || dockerHealth.Err() != nil || !service.IsStartupFailure(err) {
+			breaker.Abort(browserName, version)
+		} else if breaker.Failure(browserName, version) {
+			log.Printf("[%d] [BROWSER_DEGRADED] [%s] [%s] [Too many consecutive startup failures]", requestId, browserName, version)
+		}
+		return nil, err
+	}
+	if breaker.Success(browserName, version) {
+		log.Printf("[%d] [BROWSER_RECOVERED] [%s] [%s]", requestId, browserName, version)
+	}
+	if reserved != (protect.Resources{}) {
+		cancel := startedService.Cancel
+		startedService.Cancel = func() {
+			cancel()
+			budget.Release(reserved)
+		}
+	}
+	return startedService, nil
+}
+
+func startWithRetries(ctx context.Context, starter service.Starter, requestId uint64) (*service.StartedService, error) {
+	delay := startupRetryDelay
+	for attempt := 1; ; attempt++ {
+		startedService, err := starter.StartWithCancel()
+		if err == nil || attempt > startupRetryCount || dockerHealth.Err() != nil || !service.IsTransient(err) {
+			return startedService, err
+		}
+		log.Printf("[%d] [SERVICE_STARTUP_ATTEMPT_FAILED] [%d] [%v]", requestId, attempt, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		log.Printf("[%d] [RETRYING_SERVICE_STARTUP] [%d] [%v]", requestId, attempt+1, delay)
+		delay *= 2
+		if delay > maxStartupRetryDelay {
+			delay = maxStartupRetryDelay
+		}
+	}
+}
+
+func resolvedVersion(caps session.Caps) string {
+	if _, version, ok := conf.Find(caps.BrowserName(), caps.Version); ok {
+		return version
+	}
+	return caps.Version
+}
+
+func startWithFallback(ctx context.Context, starter service.Starter, caps session.Caps, fallbackCaps func(version string) (session.Caps, error), requestId uint64) (*service.StartedService, session.Caps, error) {
+	startedService, err := startService(ctx, starter, caps, requestId)
+	if err == nil {
+		return startedService, caps, nil
+	}
+	log.Printf("[%d] [SERVICE_STARTUP_FAILED] [%s] [%s] [%v]", requestId, caps.BrowserName(), caps.Version, err)
+	fallback, ok := starter.(service.Fallback)
+	if !ok || ctx.Err() != nil {
+		return nil, caps, err
+	}
+	for _, version := range fallback.FallbackVersions() {
+		log.Printf("[%d] [USING_FALLBACK_VERSION] [%s] [%s] [%s]", requestId, caps.BrowserName(), caps.Version, version)
+		versionCaps, capsErr := fallbackCaps(version)
+		if capsErr != nil {
+			log.Printf("[%d] [BAD_BROWSER_CAPABILITIES] [%s] [%s] [%v]", requestId, caps.BrowserName(), version, capsErr)
+			continue
+		}
+		fallbackStarter, ok := manager.Find(versionCaps, requestId)
+		if !ok {
+			log.Printf("[%d] [FALLBACK_VERSION_NOT_AVAILABLE] [%s] [%s]", requestId, caps.BrowserName(), version)
+			continue
+		}
+		startedService, err = startService(ctx, fallbackStarter, versionCaps, requestId)
+		if err != nil {
+			log.Printf("[%d] [SERVICE_STARTUP_FAILED] [%s] [%s] [%v]", requestId, caps.BrowserName(), version, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		log.Printf("[%d] [FALLBACK_VERSION_STARTED] [%s] [%s]", requestId, caps.BrowserName(), version)
+		return startedService, versionCaps, nil
+	}
+	return nil, caps, err
+}
+
+func replaceBrowserVersion(input []byte, version string) []byte {
+	body := make(map[string]interface{})
+	_ = json.Unmarshal(input, &body)
+	if raw, ok := body["desiredCapabilities"]; ok {
+		if dc, ok := raw.(map[string]interface{}); ok {
+			if _, ok := dc["version"]; ok {
+				dc["version"] = version
+			}
+			if _, ok := dc["browserVersion"]; ok {
+				dc["browserVersion"] = version
+			}
+		}
+	}
+	if raw, ok := body["capabilities"]; ok {
+		if c, ok := raw.(map[string]interface{}); ok {
+			if raw, ok := c["alwaysMatch"]; ok {
+				if am, ok := raw.(map[string]interface{}); ok {
+					if _, ok := am["browserVersion"]; ok {
+						am["browserVersion"] = version
+					}
+				}
+			}
+			if raw, ok := c["firstMatch"]; ok {
+				if fm, ok := raw.([]interface{}); ok {
+					for _, raw := range fm {
+						if c, ok := raw.(map[string]interface{}); ok {
+							if _, ok := c["browserVersion"]; ok {
+								c["browserVersion"] = version
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	ret, _ := json.Marshal(body)
+	return ret
+}
+
+func addStartedVersion(input []byte, version string) ([]byte, error) {
+	body := make(map[string]interface{})
+	err := json.Unmarshal(input, &body)
+	if err != nil {
+		return nil, fmt.Errorf("parse body response: %v", err)
+	}
+	const selenoidVersion = "selenoid:version"
+	if raw, ok := body["value"]; ok {
+		if v, ok := raw.(map[string]interface{}); ok {
+			// handle jsonwp response where value contains capabilities
+			if _, ok := body["sessionId"]; ok {
+				v[selenoidVersion] = version
+			} else if raw, ok := v["capabilities"]; ok {
+				if c, ok := raw.(map[string]interface{}); ok {
+					c[selenoidVersion] = version
+				}
+			}
+		}
+	}
+	ret, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshal response: %v", err)
+	}
+	return ret, nil
+}
+
 func removeSelenoidOptions(input []byte) []byte {
 	body := make(map[string]interface{})
 	_ = json.Unmarshal(input, &body)
@@ -591,6 +1068,7 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			r.URL.Path = paths.Error
+			r.URL.RawQuery = url.Values{"session": {id}}.Encode()
 		},
 		ErrorHandler: defaultErrorHandler(requestId),
 	}).ServeHTTP(w, r)
@@ -628,12 +1106,127 @@ func reverseProxy(hostFn func(sess *session.Session) string, status string) func
 				ErrorHandler: defaultErrorHandler(requestId),
 			}).ServeHTTP(w, r)
 		} else {
-			jsonerror.InvalidSessionID(fmt.Errorf("unknown session %s", sid)).Encode(w)
+			jsonerror.InvalidSessionID(unknownSessionError(sid)).Encode(w)
 			log.Printf("[%d] [SESSION_NOT_FOUND] [%s]", requestId, sid)
 		}
 	}
 }
 
+func emulateNetwork(w http.ResponseWriter, r *http.Request) {
+	requestId := serial()
+	sid, _ := splitRequestPath(r.URL.Path)
+	sess, ok := sessions.Get(sid)
+	if !ok {
+		jsonerror.InvalidSessionID(unknownSessionError(sid)).Encode(w)
+		log.Printf("[%d] [SESSION_NOT_FOUND] [%s]", requestId, sid)
+		return
+	}
+	if sess.Network == nil {
+		jsonerror.UnsupportedOperation(errors.New("network emulation is not enabled, pass network capability to enable it")).Encode(w)
+		return
+	}
+	sess.Lock.Lock()
+	defer sess.Lock.Unlock()
+	select {
+	case <-sess.TimeoutCh:
+	default:
+		close(sess.TimeoutCh)
+	}
+	sess.TimeoutCh = onTimeout(sess.Timeout, func() {
+		request{r}.session(sid).Delete(requestId)
+	})
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var conditions session.Network
+		err := json.NewDecoder(r.Body).Decode(&conditions)
+		if err == nil {
+			err = conditions.Validate()
+		}
+		if err != nil {
+			jsonerror.InvalidArgument(err).Encode(w)
+			return
+		}
+		err = sess.Network(&conditions)
+		if err != nil {
+			log.Printf("[%d] [NETWORK_EMULATION_FAILED] [%s] [%v]", requestId, sid, err)
+			jsonerror.UnknownError(err).Encode(w)
+			return
+		}
+		sess.Caps.Network = &conditions
+		log.Printf("[%d] [NETWORK_CONDITIONS_CHANGED] [%s]", requestId, sid)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"value": sess.Caps.Network})
+}
+
+func containerClient(c *session.Container) *client.Client {
+	if cl, ok := hosts.Client(c.Host); ok {
+		return cl
+	}
+	return dockerClient()
+}
+
+func onContainerExit(exit service.ContainerExit) {
+	var sid string
+	var sess *session.Session
+	sessions.Each(func(k string, s *session.Session) {
+		if s.Container != nil && s.Container.ID == exit.ID {
+			sid, sess = k, s
+		}
+	})
+	if sess == nil {
+		return
+	}
+	requestId := serial()
+	sess.Lock.Lock()
+	if current, ok := sessions.Get(sid); !ok || current != sess {
+		sess.Lock.Unlock()
+		return
+	}
+	select {
+	case <-sess.TimeoutCh:
+	default:
+		close(sess.TimeoutCh)
+	}
+	sessions.Remove(sid)
+	queue.Release()
+	sess.Lock.Unlock()
+	terminatedLock.Lock()
+	terminated[sid] = exit
+	terminatedLock.Unlock()
+	time.AfterFunc(maxTimeout, func() {
+		terminatedLock.Lock()
+		defer terminatedLock.Unlock()
+		delete(terminated, sid)
+	})
+	log.Printf("[%d] [SESSION_TERMINATED] [%s] [%s] [Exit code: %d, OOM killed: %t]", requestId, sid, exit.ID, exit.ExitCode, exit.OOMKilled)
+	if enableFileUpload {
+		_ = os.RemoveAll(filepath.Join(os.TempDir(), sid))
+	}
+	sess.Cancel()
+}
+
+func terminatedSessionError(sid string) error {
+	terminatedLock.RLock()
+	defer terminatedLock.RUnlock()
+	exit, ok := terminated[sid]
+	if !ok {
+		return nil
+	}
+	return fmt.Errorf("session %s was terminated: browser container exited with code %d (OOM killed: %t)", sid, exit.ExitCode, exit.OOMKilled)
+}
+
+func unknownSessionError(sid string) error {
+	if err := terminatedSessionError(sid); err != nil {
+		return err
+	}
+	return fmt.Errorf("unknown session %s", sid)
+}
+
 func splitRequestPath(p string) (string, string) {
 	fragments := strings.Split(p, slash)
 	return fragments[2], slash + strings.Join(fragments[3:], slash)
@@ -771,18 +1364,28 @@ func streamLogs(wsconn *websocket.Conn) {
 	sess, ok := sessions.Get(sid)
 	if ok && sess.Container != nil {
 		log.Printf("[%d] [CONTAINER_LOGS] [%s]", requestId, sess.Container.ID)
-		r, err := cli.ContainerLogs(wsconn.Request().Context(), sess.Container.ID, container.LogsOptions{
-			ShowStdout: true,
-			ShowStderr: true,
-			Follow:     true,
-		})
+		var r io.ReadCloser
+		var err error
+		if sess.Logs != nil {
+			r, err = sess.Logs(wsconn.Request().Context())
+		} else {
+			r, err = containerClient(sess.Container).ContainerLogs(wsconn.Request().Context(), sess.Container.ID, container.LogsOptions{
+				ShowStdout: true,
+				ShowStderr: true,
+				Follow:     true,
+			})
+		}
 		if err != nil {
 			log.Printf("[%d] [CONTAINER_LOGS_ERROR] [%v]", requestId, err)
 			return
 		}
 		defer r.Close()
 		wsconn.PayloadType = websocket.BinaryFrame
-		_, _ = stdcopy.StdCopy(wsconn, wsconn, r)
+		if sess.Logs != nil {
+			_, _ = io.Copy(wsconn, r)
+		} else {
+			_, _ = stdcopy.StdCopy(wsconn, wsconn, r)
+		}
 		log.Printf("[%d] [CONTAINER_LOGS_DISCONNECTED] [%s]", requestId, sid)
 	} else {
 		log.Printf("[%d] [SESSION_NOT_FOUND] [%s]", requestId, sid)
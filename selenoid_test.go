@@ -12,11 +12,15 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	ggr "github.com/aerokube/ggr/config"
 	"github.com/aerokube/selenoid/config"
+	"github.com/aerokube/selenoid/protect"
+	"github.com/aerokube/selenoid/service"
+	"github.com/aerokube/selenoid/session"
 	"github.com/mafredri/cdp"
 	"github.com/mafredri/cdp/rpcc"
 	assert "github.com/stretchr/testify/require"
@@ -213,6 +217,273 @@ func TestSessionCreated(t *testing.T) {
 	queue.Release()
 }
 
+func TestSessionCreatedWithFallbackVersion(t *testing.T) {
+	manager = &FallbackTest{
+		HTTPTest:      HTTPTest{Handler: Selenium(func(resp map[string]interface{}) { resp["value"] = map[string]interface{}{} })},
+		BrokenVersion: "120.0",
+		Fallback:      []string{"119.0", "118.0"},
+	}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities":{"browserName":"firefox", "version":"120.0"}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess struct {
+		ID    string                 `json:"sessionId"`
+		Value map[string]interface{} `json:"value"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+	assert.Equal(t, sess.Value["selenoid:version"], "119.0")
+
+	resp, err = http.Get(With(srv.URL).Path("/status"))
+	assert.NoError(t, err)
+	var state config.State
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.Contains(t, state.Browsers["firefox"], "119.0")
+	assert.NotContains(t, state.Browsers["firefox"], "120.0")
+	sessions.Remove(sess.ID)
+	queue.Release()
+}
+
+func TestSessionFailedWithoutFallbackVersion(t *testing.T) {
+	manager = &FallbackTest{
+		HTTPTest:      HTTPTest{Handler: Selenium()},
+		BrokenVersion: "120.0",
+	}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities":{"browserName":"firefox", "version":"120.0"}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	assert.Equal(t, queue.Used(), 0)
+}
+
+func TestReplaceBrowserVersion(t *testing.T) {
+	body := replaceBrowserVersion([]byte(`{"desiredCapabilities":{"version":"120.0"},"capabilities":{"alwaysMatch":{"browserVersion":"120.0"},"firstMatch":[{"browserVersion":"120.0"},{}]}}`), "119.0")
+	assert.JSONEq(t, `{"desiredCapabilities":{"version":"119.0"},"capabilities":{"alwaysMatch":{"browserVersion":"119.0"},"firstMatch":[{"browserVersion":"119.0"},{}]}}`, string(body))
+}
+
+func TestSessionCreatedWithBrowserCapabilities(t *testing.T) {
+	oldConf := conf
+	defer func() {
+		conf = oldConf
+	}()
+	conf = config.NewConfig()
+	conf.Browsers["chrome"] = config.Versions{
+		Default: "119.0",
+		Versions: map[string]*config.Browser{
+			"119.0": {
+				DefaultCapabilities: map[string]interface{}{
+					"acceptInsecureCerts": true,
+					"selenoid:options":    map[string]interface{}{"enableVNC": true, "timeZone": "Europe/Berlin"},
+				},
+				ForcedCapabilities: map[string]interface{}{
+					"enableVideo":        false,
+					"timeZone":           "Europe/Moscow",
+					"goog:chromeOptions": map[string]interface{}{"args": []interface{}{"--disable-dev-shm-usage"}},
+				},
+			},
+		},
+	}
+	var forwarded map[string]interface{}
+	selenium := Selenium()
+	manager = &HTTPTest{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/session" {
+			_ = json.NewDecoder(r.Body).Decode(&forwarded)
+		}
+		selenium.ServeHTTP(w, r)
+	})}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"capabilities":{"alwaysMatch":{"browserName":"chrome", "acceptInsecureCerts":false, "goog:chromeOptions":{"args":["--headless"]}, "selenoid:options":{"enableVideo":true}}}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+
+	alwaysMatch := forwarded["capabilities"].(map[string]interface{})["alwaysMatch"].(map[string]interface{})
+	assert.Equal(t, alwaysMatch["acceptInsecureCerts"], false)
+	assert.Equal(t, alwaysMatch["goog:chromeOptions"], map[string]interface{}{"args": []interface{}{"--headless", "--disable-dev-shm-usage"}})
+	assert.NotContains(t, alwaysMatch, "timeZone")
+	assert.NotContains(t, alwaysMatch, "selenoid:options")
+
+	s, ok := sessions.Get(sess["sessionId"])
+	assert.True(t, ok)
+	assert.True(t, s.Caps.VNC)
+	assert.False(t, s.Caps.Video)
+	assert.Equal(t, s.Caps.TimeZone, "Europe/Moscow")
+	sessions.Remove(sess["sessionId"])
+	queue.Release()
+}
+
+func TestSessionCreatedWithJSONWPBrowserCapabilities(t *testing.T) {
+	oldConf := conf
+	defer func() {
+		conf = oldConf
+	}()
+	conf = config.NewConfig()
+	conf.Browsers["chrome"] = config.Versions{
+		Default: "119.0",
+		Versions: map[string]*config.Browser{
+			"119.0": {
+				DefaultCapabilities: map[string]interface{}{
+					"acceptInsecureCerts": true,
+					"enableVNC":           true,
+				},
+				ForcedCapabilities: map[string]interface{}{
+					"timeZone":           "Europe/Moscow",
+					"selenoid:options":   map[string]interface{}{"enableVideo": false},
+					"goog:chromeOptions": map[string]interface{}{"args": []interface{}{"--disable-dev-shm-usage"}},
+				},
+			},
+		},
+	}
+	var forwarded map[string]interface{}
+	selenium := Selenium()
+	manager = &HTTPTest{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/session" {
+			_ = json.NewDecoder(r.Body).Decode(&forwarded)
+		}
+		selenium.ServeHTTP(w, r)
+	})}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities":{"browserName":"chrome", "enableVideo":true, "goog:chromeOptions":{"args":["--headless"]}}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+
+	desired := forwarded["desiredCapabilities"].(map[string]interface{})
+	assert.Equal(t, desired["acceptInsecureCerts"], true)
+	assert.Equal(t, desired["goog:chromeOptions"], map[string]interface{}{"args": []interface{}{"--headless", "--disable-dev-shm-usage"}})
+	assert.NotContains(t, desired, "enableVNC")
+	assert.NotContains(t, desired, "timeZone")
+	assert.NotContains(t, desired, "selenoid:options")
+
+	s, ok := sessions.Get(sess["sessionId"])
+	assert.True(t, ok)
+	assert.True(t, s.Caps.VNC)
+	assert.False(t, s.Caps.Video)
+	assert.Equal(t, s.Caps.TimeZone, "Europe/Moscow")
+	sessions.Remove(sess["sessionId"])
+	queue.Release()
+}
+
+func TestSessionCreatedWithFallbackVersionCapabilities(t *testing.T) {
+	oldConf := conf
+	defer func() {
+		conf = oldConf
+	}()
+	conf = config.NewConfig()
+	conf.Browsers["chrome"] = config.Versions{
+		Default: "120.0",
+		Versions: map[string]*config.Browser{
+			"120.0": {
+				DefaultCapabilities: map[string]interface{}{
+					"pageLoadStrategy": "eager",
+					"selenoid:options": map[string]interface{}{"enableVNC": true},
+				},
+				ForcedCapabilities: map[string]interface{}{
+					"timeZone":           "Europe/Berlin",
+					"goog:chromeOptions": map[string]interface{}{"args": []interface{}{"--enable-features=New"}},
+				},
+			},
+			"119.0": {
+				ForcedCapabilities: map[string]interface{}{
+					"timeZone":           "Europe/Moscow",
+					"goog:chromeOptions": map[string]interface{}{"args": []interface{}{"--disable-dev-shm-usage"}},
+				},
+			},
+		},
+	}
+	var forwarded map[string]interface{}
+	selenium := Selenium()
+	manager = &FallbackTest{
+		HTTPTest: HTTPTest{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/session" {
+				_ = json.NewDecoder(r.Body).Decode(&forwarded)
+			}
+			selenium.ServeHTTP(w, r)
+		})},
+		BrokenVersion: "120.0",
+		Fallback:      []string{"119.0"},
+	}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"capabilities":{"alwaysMatch":{"browserName":"chrome", "browserVersion":"120.0"}}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+
+	alwaysMatch := forwarded["capabilities"].(map[string]interface{})["alwaysMatch"].(map[string]interface{})
+	assert.Equal(t, alwaysMatch["browserVersion"], "119.0")
+	assert.Equal(t, alwaysMatch["goog:chromeOptions"], map[string]interface{}{"args": []interface{}{"--disable-dev-shm-usage"}})
+	assert.NotContains(t, alwaysMatch, "pageLoadStrategy")
+
+	s, ok := sessions.Get(sess["sessionId"])
+	assert.True(t, ok)
+	assert.Equal(t, s.Caps.Version, "119.0")
+	assert.False(t, s.Caps.VNC)
+	assert.Equal(t, s.Caps.TimeZone, "Europe/Moscow")
+	sessions.Remove(sess["sessionId"])
+	queue.Release()
+}
+
+func TestSessionCreatedWithExplicitFalseCapability(t *testing.T) {
+	oldConf := conf
+	defer func() {
+		conf = oldConf
+	}()
+	conf = config.NewConfig()
+	conf.Browsers["chrome"] = config.Versions{
+		Default: "119.0",
+		Versions: map[string]*config.Browser{
+			"119.0": {
+				DefaultCapabilities: map[string]interface{}{
+					"selenoid:options": map[string]interface{}{"enableVNC": true, "enableVideo": true},
+				},
+			},
+		},
+	}
+	manager = &HTTPTest{Handler: Selenium()}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"capabilities":{"alwaysMatch":{"browserName":"chrome", "selenoid:options":{"enableVNC":false}}}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+
+	s, ok := sessions.Get(sess["sessionId"])
+	assert.True(t, ok)
+	assert.False(t, s.Caps.VNC)
+	assert.True(t, s.Caps.Video)
+	sessions.Remove(sess["sessionId"])
+	queue.Release()
+}
+
+func TestCustomImageNotAllowed(t *testing.T) {
+	oldConf := conf
+	defer func() {
+		conf = oldConf
+	}()
+	conf = config.NewConfig()
+	browser := &config.Browser{Image: "selenoid/chrome:119.0", AllowedImages: []string{`^registry\.example\.com/.+$`}}
+	assert.NoError(t, browser.Compile())
+	conf.Browsers["chrome"] = config.Versions{
+		Default:  "119.0",
+		Versions: map[string]*config.Browser{"119.0": browser},
+	}
+	manager = &HTTPTest{Handler: Selenium()}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"capabilities":{"alwaysMatch":{"browserName":"chrome", "selenoid:options":{"image":"evil.example.com/chrome:119.0"}}}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	var e struct {
+		Value map[string]string `json:"value"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+	assert.Equal(t, e.Value["error"], "invalid argument")
+	assert.Equal(t, e.Value["message"], "image evil.example.com/chrome:119.0 is not allowed for chrome 119.0")
+	assert.Equal(t, queue.Used(), 0)
+}
+
 func TestSessionCreatedW3C(t *testing.T) {
 	manager = &HTTPTest{Handler: Selenium()}
 
@@ -385,6 +656,210 @@ func TestSessionFailedAfterTwoTimeout(t *testing.T) {
 	assert.Equal(t, queue.Used(), 0)
 }
 
+func TestSessionFailedAfterBrowserRetryCount(t *testing.T) {
+	retryCount = 1
+	newSessionAttemptTimeout = 10 * time.Second
+	defer func() {
+		newSessionAttemptTimeout = 1 * time.Second
+	}()
+	var lock sync.Mutex
+	attempts := 0
+	manager = &HTTPTest{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			attempts++
+			lock.Unlock()
+			<-time.After(100 * time.Millisecond)
+		}),
+		AttemptTimeout: 10 * time.Millisecond,
+		RetryCount:     3,
+	}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, attempts, 3)
+	assert.Equal(t, queue.Used(), 0)
+}
+
+func TestSessionWaitsForResources(t *testing.T) {
+	budget = protect.NewBudget(protect.Resources{Mem: 1024, CPU: 1000})
+	defer func() {
+		budget = nil
+	}()
+	manager = &ConsumerTest{
+		HTTPTest: HTTPTest{Handler: Selenium()},
+		Mem:      768,
+		CPU:      500,
+	}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+
+	resp, err = http.Get(With(srv.URL).Path("/status"))
+	assert.NoError(t, err)
+	var state config.State
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.NotNil(t, state.Budget)
+	assert.Equal(t, state.Budget.Used, protect.Resources{Mem: 768, CPU: 500})
+	assert.Equal(t, state.Budget.Free, protect.Resources{Mem: 256, CPU: 500})
+
+	created := make(chan map[string]string)
+	go func() {
+		var sess map[string]string
+		resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+		if err == nil {
+			_ = json.NewDecoder(resp.Body).Decode(&sess)
+		}
+		created <- sess
+	}()
+	select {
+	case <-created:
+		t.Fatal("session should wait for resources")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, queue.Pending(), 0)
+	assert.Equal(t, queue.Queued(), 1)
+
+	req, _ := http.NewRequest(http.MethodDelete, With(srv.URL).Path(fmt.Sprintf("/wd/hub/session/%s", sess["sessionId"])), nil)
+	_, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	sess = <-created
+	assert.NotEmpty(t, sess["sessionId"])
+
+	req, _ = http.NewRequest(http.MethodDelete, With(srv.URL).Path(fmt.Sprintf("/wd/hub/session/%s", sess["sessionId"])), nil)
+	_, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, budget.State().Used, protect.Resources{})
+	assert.Equal(t, queue.Used(), 0)
+}
+
+func TestSessionWithoutLimitsChargesShare(t *testing.T) {
+	budget = protect.NewBudget(protect.Resources{Mem: int64(limit) * 1024, CPU: int64(limit) * 1000})
+	defer func() {
+		budget = nil
+	}()
+	manager = &ConsumerTest{HTTPTest: HTTPTest{Handler: Selenium()}}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+	assert.Equal(t, budget.State().Used, protect.Resources{Mem: 1024, CPU: 1000})
+
+	req, _ := http.NewRequest(http.MethodDelete, With(srv.URL).Path(fmt.Sprintf("/wd/hub/session/%s", sess["sessionId"])), nil)
+	_, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, budget.State().Used, protect.Resources{})
+}
+
+func TestSessionRejectedWhenResourcesExceedTotal(t *testing.T) {
+	budget = protect.NewBudget(protect.Resources{Mem: 1024})
+	defer func() {
+		budget = nil
+	}()
+	manager = &ConsumerTest{
+		HTTPTest: HTTPTest{Handler: Selenium()},
+		Mem:      2048,
+	}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	assert.Equal(t, queue.Used(), 0)
+	assert.Equal(t, budget.State().Used, protect.Resources{})
+}
+
+func TestDegradedBrowserVersion(t *testing.T) {
+	breaker = protect.NewBreaker(2, time.Minute)
+	defer func() {
+		breaker = nil
+	}()
+	manager = &StartupError{}
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities": {"browserName": "broken", "version": "1.0", "image": "custom/broken:1.0"}}`)))
+		assert.NoError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	}
+	assert.Empty(t, breaker.State())
+
+	manager = &RequestError{}
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities": {"browserName": "broken", "version": "1.0"}}`)))
+		assert.NoError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	}
+	assert.Empty(t, breaker.State())
+
+	manager = &StartupError{}
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities": {"browserName": "broken", "version": "1.0"}}`)))
+		assert.NoError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities": {"browserName": "broken", "version": "1.0"}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	var e struct {
+		Value struct {
+			Message string `json:"message"`
+		} `json:"value"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+	assert.Contains(t, e.Value.Message, "broken 1.0 is degraded after 2 consecutive startup failures")
+	assert.Equal(t, queue.Used(), 0)
+
+	resp, err = http.Get(With(srv.URL).Path("/status"))
+	assert.NoError(t, err)
+	var state config.State
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.Len(t, state.Degraded, 1)
+	assert.Equal(t, state.Degraded[0].Browser, "broken")
+	assert.Equal(t, state.Degraded[0].Failures, 2)
+}
+
+func TestStartupRetries(t *testing.T) {
+	startupRetryCount, startupRetryDelay = 2, time.Millisecond
+	defer func() {
+		startupRetryCount, startupRetryDelay = 0, time.Second
+	}()
+	flaky := &FlakyStartup{HTTPTest: HTTPTest{Handler: Selenium()}, Failures: 2}
+	manager = flaky
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, flaky.Attempts, 3)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+	sessions.Remove(sess["sessionId"])
+	queue.Release()
+
+	flaky = &FlakyStartup{HTTPTest: HTTPTest{Handler: Selenium()}, Failures: 3}
+	manager = flaky
+	resp, err = http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	assert.Equal(t, flaky.Attempts, 3)
+	assert.Equal(t, queue.Used(), 0)
+
+	flaky = &FlakyStartup{HTTPTest: HTTPTest{Handler: Selenium()}, Failures: 1, Permanent: true}
+	manager = flaky
+	resp, err = http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	assert.Equal(t, flaky.Attempts, 1)
+	assert.Equal(t, queue.Used(), 0)
+}
+
 func TestSessionCreatedRedirect(t *testing.T) {
 	httpClient := &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -980,6 +1455,97 @@ func TestAddedSeCdpCapability(t *testing.T) {
 	queue.Release()
 }
 
+func TestChangeNetworkConditions(t *testing.T) {
+	var applied []session.Network
+	sessions.Put("network-session", &session.Session{
+		Caps: session.Caps{Network: &session.Network{Latency: 100}},
+		Network: func(network *session.Network) error {
+			applied = append(applied, *network)
+			return nil
+		},
+		Timeout:   time.Minute,
+		TimeoutCh: make(chan struct{}),
+	})
+	defer sessions.Remove("network-session")
+	sessions.Put("plain-session", &session.Session{Timeout: time.Minute, TimeoutCh: make(chan struct{})})
+	defer sessions.Remove("plain-session")
+
+	resp, err := http.Get(With(srv.URL).Path("/wd/hub/session/network-session/aerokube/network"))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var conditions struct {
+		Value session.Network `json:"value"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&conditions))
+	assert.Equal(t, conditions.Value, session.Network{Latency: 100})
+
+	resp, err = http.Post(With(srv.URL).Path("/wd/hub/session/network-session/aerokube/network"), "", bytes.NewReader([]byte(`{"latency": 300, "loss": 2}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&conditions))
+	assert.Equal(t, conditions.Value, session.Network{Latency: 300, Loss: 2})
+	assert.Equal(t, applied, []session.Network{{Latency: 300, Loss: 2}})
+
+	resp, err = http.Post(With(srv.URL).Path("/network/network-session"), "", bytes.NewReader([]byte(`{"loss": 200}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	assert.Len(t, applied, 1)
+
+	resp, err = http.Post(With(srv.URL).Path("/network/plain-session"), "", bytes.NewReader([]byte(`{"latency": 300}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+
+	resp, err = http.Get(With(srv.URL).Path("/network/missing-session"))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+}
+
+func TestBadNetworkConditionsCapability(t *testing.T) {
+	manager = &HTTPTest{Handler: Selenium()}
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte(`{"desiredCapabilities": {"network": {"latency": -1}}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	assert.Equal(t, queue.Used(), 0)
+}
+
+func TestSessionTerminatedOnContainerExit(t *testing.T) {
+	ch := make(chan bool)
+	manager = &HTTPTest{Handler: Selenium(), Cancel: ch}
+
+	resp, err := http.Post(With(srv.URL).Path("/wd/hub/session"), "", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var sess map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sess))
+	sid := sess["sessionId"]
+	s, ok := sessions.Get(sid)
+	assert.True(t, ok)
+	s.Container = &session.Container{ID: "a1a2a3a4a5a6"}
+
+	onContainerExit(service.ContainerExit{ID: "unknown"})
+	assert.Equal(t, queue.Used(), 1)
+	onContainerExit(service.ContainerExit{ID: "a1a2a3a4a5a6", ExitCode: 137, OOMKilled: true})
+	assert.True(t, <-ch)
+	assert.Equal(t, queue.Used(), 0)
+	_, ok = sessions.Get(sid)
+	assert.False(t, ok)
+
+	resp, err = http.Get(With(srv.URL).Path(fmt.Sprintf("/wd/hub/session/%s/url", sid)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	var e struct {
+		Value struct {
+			Message string `json:"message"`
+		} `json:"value"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+	assert.Equal(t, e.Value.Message, fmt.Sprintf("session %s was terminated: browser container exited with code 137 (OOM killed: true)", sid))
+
+	resp, err = http.Get(With(srv.URL).Path("/network/" + sid))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+}
+
 func TestParseGgrHost(t *testing.T) {
 	h := parseGgrHost("some-host.example.com:4444")
 	assert.Equal(t, h.Name, "some-host.example.com")
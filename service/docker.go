@@ -2,14 +2,18 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aerokube/selenoid/info"
 	"github.com/docker/docker/api/types"
+	"io"
 	"log"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -23,11 +27,14 @@ import (
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/docker/go-units"
+	"github.com/google/uuid"
 )
 
 const (
-	sysAdmin               = "SYS_ADMIN"
-	overrideVideoOutputDir = "OVERRIDE_VIDEO_OUTPUT_DIR"
+	sysAdmin                 = "SYS_ADMIN"
+	netAdmin                 = "NET_ADMIN"
+	overrideVideoOutputDir   = "OVERRIDE_VIDEO_OUTPUT_DIR"
+	networkConditionsTimeout = 10 * time.Second
 )
 
 var ports = struct {
@@ -59,7 +66,7 @@ func (limit *MemLimit) Set(s string) error {
 type CpuLimit int64
 
 func (limit *CpuLimit) String() string {
-	return strconv.FormatFloat(float64(*limit/1000000000), 'f', -1, 64)
+	return strconv.FormatFloat(float64(*limit)/1000000000, 'f', -1, 64)
 }
 
 func (limit *CpuLimit) Set(s string) error {
@@ -78,6 +85,8 @@ type Docker struct {
 	session.Caps
 	LogConfig *ctr.LogConfig
 	Client    *client.Client
+	Hosts     *Hosts
+	Health    *DockerHealth
 }
 
 type portConfig struct {
@@ -92,15 +101,44 @@ type portConfig struct {
 
 // StartWithCancel - Starter interface implementation
 func (d *Docker) StartWithCancel() (*StartedService, error) {
-	portConfig, err := getPortConfig(d.Service, d.Caps, d.Environment)
+	err := d.Health.Err()
+	if err != nil {
+		return nil, err
+	}
+	requestId := d.RequestId
+	image := d.Service.Image
+	ctx := context.Background()
+	cl := d.Client
+	environ := d.Environment
+	var host *DockerHost
+	if d.Hosts != nil {
+		host, err = d.Hosts.Acquire(ctx, image.(string))
+		if err != nil {
+			return nil, fmt.Errorf("choose docker host: %v", err)
+		}
+		if d.Video && !host.Local {
+			d.Hosts.Release(host)
+			return nil, fmt.Errorf("video recording is not supported on remote Docker host %s", host.Name)
+		}
+		cl = host.Client
+		environ.IP = host.IP
+		log.Printf("[%d] [USING_DOCKER_HOST] [%s] [%s]", requestId, host.Name, image)
+	}
+	started := false
+	defer func() {
+		if !started {
+			d.Hosts.Release(host)
+		}
+	}()
+	portConfig, err := getPortConfig(d.Service, d.Caps, environ)
 	if err != nil {
 		return nil, fmt.Errorf("configuring ports: %v", err)
 	}
-	mem, err := getMemory(d.Service, d.Environment)
+	mem, err := getMemory(d.ServiceBase, d.Caps, d.Environment)
 	if err != nil {
 		return nil, fmt.Errorf("invalid memory limit: %v", err)
 	}
-	cpu, err := getCpu(d.Service, d.Environment)
+	cpu, err := getCpu(d.ServiceBase, d.Caps, d.Environment)
 	if err != nil {
 		return nil, fmt.Errorf("invalid CPU limit: %v", err)
 	}
@@ -109,24 +147,85 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 	clipboard := portConfig.ClipboardPort
 	vnc := portConfig.VNCPort
 	devtools := portConfig.DevtoolsPort
-	requestId := d.RequestId
-	image := d.Service.Image
-	ctx := context.Background()
+	if d.Service.Digest != "" {
+		err = verifyImageDigest(ctx, cl, image.(string), d.Service.Digest)
+		if err != nil {
+			return nil, &StartupFailure{Err: fmt.Errorf("verify image: %v", err)}
+		}
+		log.Printf("[%d] [IMAGE_DIGEST_VERIFIED] [%s] [%s]", requestId, image, d.Service.Digest)
+	}
+	ulimits, err := getUlimits(d.Service)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ulimits: %v", err)
+	}
+	devices, err := getDevices(d.Service)
+	if err != nil {
+		return nil, fmt.Errorf("invalid devices: %v", err)
+	}
+	egressPolicy := getEgressPolicy(d.Service, d.Caps)
+	enforceEgress := egressPolicy.Enforced()
+	if enforceEgress {
+		if d.EgressProxy == nil || d.EgressNetwork == "" || !d.InDocker {
+			return nil, errors.New("egress policy requires Selenoid running in Docker with egress network")
+		}
+		if len(d.AdditionalNetworks) > 0 {
+			return nil, errors.New("additional networks are not allowed with egress policy")
+		}
+	}
+	reachable := environ
+	if enforceEgress {
+		reachable.Network = d.EgressNetwork
+	}
+	var sn *sessionNetwork
+	if d.Service.SessionNetwork || d.Caps.SessionNetwork || len(d.Sidecars) > 0 || enforceEgress {
+		sn, err = createSessionNetwork(ctx, cl, requestId, enforceEgress, d.ApplicationContainers)
+		if err != nil {
+			return nil, fmt.Errorf("create session network: %v", err)
+		}
+		environ.Network = sn.Name
+		if d.InDocker && environ.IP == "" && !enforceEgress {
+			err = sn.connect(ctx, cl, d.Hostname, nil)
+			if err != nil {
+				sn.remove(ctx, cl, requestId)
+				return nil, fmt.Errorf("connect selenoid container %s to network %s: %v", d.Hostname, sn.Name, err)
+			}
+			reachable.Network = sn.Name
+		}
+	}
+	defer func() {
+		if !started {
+			sn.remove(ctx, cl, requestId)
+		}
+	}()
+	for _, sidecar := range d.Sidecars {
+		err = sn.startSidecar(ctx, cl, requestId, sidecar, mem, cpu, d.StartupTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("start sidecar %s: %v", sidecar.Image, err)
+		}
+	}
 	log.Printf("[%d] [CREATING_CONTAINER] [%s]", requestId, image)
 	hostConfig := ctr.HostConfig{
 		Binds:        d.Service.Volumes,
 		AutoRemove:   true,
 		PortBindings: portConfig.PortBindings,
 		LogConfig:    getLogConfig(*d.LogConfig, d.Caps),
-		NetworkMode:  ctr.NetworkMode(d.Network),
+		NetworkMode:  ctr.NetworkMode(environ.Network),
 		Tmpfs:        d.Service.Tmpfs,
 		ShmSize:      getShmSize(d.Service),
 		Privileged:   d.Privileged,
 		Resources: ctr.Resources{
 			Memory:   mem,
 			NanoCPUs: cpu,
+			Ulimits:  ulimits,
+			Devices:  devices,
 		},
-		ExtraHosts: getExtraHosts(d.Service, d.Caps),
+		ExtraHosts:     getExtraHosts(d.Service, d.Caps),
+		CapDrop:        d.Service.CapDrop,
+		SecurityOpt:    d.Service.SecurityOpt,
+		ReadonlyRootfs: d.Service.ReadOnlyRootfs,
+		Init:           d.Service.Init,
+		Runtime:        d.Service.Runtime,
+		GroupAdd:       d.Service.GroupAdd,
 	}
 	hostConfig.PublishAllPorts = d.Service.PublishAllPorts
 	if len(d.Caps.DNSServers) > 0 {
@@ -135,19 +234,26 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 	if !d.Privileged {
 		hostConfig.CapAdd = strslice.StrSlice{sysAdmin}
 	}
+	hostConfig.CapAdd = append(hostConfig.CapAdd, d.Service.CapAdd...)
+	if d.Caps.Network != nil && !d.Privileged {
+		hostConfig.CapAdd = append(hostConfig.CapAdd, netAdmin)
+	}
 	if len(d.ApplicationContainers) > 0 {
 		hostConfig.Links = d.ApplicationContainers
 	}
 	if len(d.Service.Sysctl) > 0 {
 		hostConfig.Sysctls = d.Service.Sysctl
 	}
-	cl := d.Client
 	env := getEnv(d.ServiceBase, d.Caps)
+	if enforceEgress {
+		env = append(env, getProxyEnv(d.EgressProxyAddr)...)
+	}
 	cfg := &ctr.Config{
 		Image:        image.(string),
 		Env:          env,
 		ExposedPorts: portConfig.ExposedPorts,
 		Labels:       getLabels(d.Service, d.Caps),
+		User:         d.Service.User,
 	}
 	hn := getContainerHostname(d.Caps)
 	if hn != "" {
@@ -158,7 +264,7 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 		&hostConfig,
 		&network.NetworkingConfig{}, nil, "")
 	if err != nil {
-		return nil, fmt.Errorf("create container: %v", err)
+		return nil, &StartupFailure{Err: fmt.Errorf("create container: %v", err)}
 	}
 	browserContainerStartTime := time.Now()
 	browserContainerId := container.ID
@@ -167,14 +273,23 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 	err = cl.ContainerStart(ctx, browserContainerId, ctr.StartOptions{})
 	if err != nil {
 		removeContainer(ctx, cl, requestId, browserContainerId)
-		return nil, fmt.Errorf("start container: %v", err)
+		return nil, &StartupFailure{Err: fmt.Errorf("start container: %v", err), Transient: true}
 	}
 	log.Printf("[%d] [CONTAINER_STARTED] [%s] [%s] [%.2fs]", requestId, image, browserContainerId, info.SecondsSince(browserContainerStartTime))
 
+	if enforceEgress {
+		err = cl.NetworkConnect(ctx, getNetworkName(reachable.Network), browserContainerId, nil)
+		if err != nil {
+			removeContainer(ctx, cl, requestId, browserContainerId)
+			return nil, fmt.Errorf("failed to connect container %s to network %s: %v", browserContainerId, reachable.Network, err)
+		}
+	}
+
 	if len(d.AdditionalNetworks) > 0 {
 		for _, networkName := range d.AdditionalNetworks {
 			err = cl.NetworkConnect(ctx, networkName, browserContainerId, nil)
 			if err != nil {
+				removeContainer(ctx, cl, requestId, browserContainerId)
 				return nil, fmt.Errorf("failed to connect container %s to network %s: %v", browserContainerId, networkName, err)
 			}
 		}
@@ -183,12 +298,12 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 	stat, err := cl.ContainerInspect(ctx, browserContainerId)
 	if err != nil {
 		removeContainer(ctx, cl, requestId, browserContainerId)
-		return nil, fmt.Errorf("inspect container %s: %s", browserContainerId, err)
+		return nil, &StartupFailure{Err: fmt.Errorf("inspect container %s: %s", browserContainerId, err), Transient: true}
 	}
-	_, ok := stat.NetworkSettings.Ports[selenium]
-	if !ok {
+	bindings, ok := stat.NetworkSettings.Ports[selenium]
+	if !ok || (len(portConfig.PortBindings) > 0 && len(bindings) == 0) {
 		removeContainer(ctx, cl, requestId, browserContainerId)
-		return nil, fmt.Errorf("no bindings available for %v", selenium)
+		return nil, &StartupFailure{Err: fmt.Errorf("no bindings available for %v", selenium), Transient: true}
 	}
 	servicePort := d.Service.Port
 	pc := map[string]nat.Port{
@@ -198,26 +313,43 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 		ports.Fileserver: fileserver,
 		ports.Clipboard:  clipboard,
 	}
-	hostPort := getHostPort(d.Environment, servicePort, d.Caps, stat, pc)
+	hostPort := getHostPort(reachable, servicePort, d.Caps, stat, pc)
 	u := &url.URL{Scheme: "http", Host: hostPort.Selenium, Path: d.Service.Path}
 
 	if d.Video {
-		videoContainerId, err = startVideoContainer(ctx, cl, requestId, stat, d.Environment, d.ServiceBase, d.Caps)
+		videoContainerId, err = startVideoContainer(ctx, cl, requestId, stat, environ, d.ServiceBase, d.Caps)
 		if err != nil {
+			removeContainer(ctx, cl, requestId, browserContainerId)
 			return nil, fmt.Errorf("start video container: %v", err)
 		}
 	}
 
 	serviceStartTime := time.Now()
-	err = wait(u.String(), d.StartupTimeout)
+	err = waitBrowserReady(ctx, cl, browserContainerId, u.String(), d.StartupTimeout, d.Service.Readiness)
 	if err != nil {
 		if videoContainerId != "" {
 			stopVideoContainer(ctx, cl, requestId, videoContainerId, d.Environment)
 		}
 		removeContainer(ctx, cl, requestId, browserContainerId)
-		return nil, fmt.Errorf("wait: %v", err)
+		return nil, &StartupFailure{Err: fmt.Errorf("wait: %v", err), Transient: true}
 	}
 	log.Printf("[%d] [SERVICE_STARTED] [%s] [%s] [%.2fs]", requestId, image, browserContainerId, info.SecondsSince(serviceStartTime))
+	var emulateNetwork func(network *session.Network) error
+	if d.Caps.Network != nil {
+		emulateNetwork = func(network *session.Network) error {
+			return setNetworkConditions(ctx, cl, requestId, browserContainerId, network)
+		}
+		if *d.Caps.Network != (session.Network{}) {
+			err = emulateNetwork(d.Caps.Network)
+			if err != nil {
+				if videoContainerId != "" {
+					stopVideoContainer(ctx, cl, requestId, videoContainerId, d.Environment)
+				}
+				removeContainer(ctx, cl, requestId, browserContainerId)
+				return nil, fmt.Errorf("emulate network: %v", err)
+			}
+		}
+	}
 	log.Printf("[%d] [PROXY_TO] [%s] [%s]", requestId, browserContainerId, u.String())
 
 	var publishedPortsInfo map[string]string
@@ -225,6 +357,18 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 		publishedPortsInfo = getContainerPorts(stat)
 	}
 
+	var proxy string
+	containerIP := getContainerIP(reachable.Network, stat)
+	if enforceEgress {
+		proxy = d.EgressProxyAddr
+		d.EgressProxy.Register(containerIP, egressPolicy)
+		log.Printf("[%d] [EGRESS_POLICY_APPLIED] [%s] [%s] [%s]", requestId, browserContainerId, containerIP, egressPolicy.Mode)
+	}
+
+	usage := &session.UsageRecorder{}
+	statsCtx, stopStats := context.WithCancel(ctx)
+	go collectStats(statsCtx, cl, requestId, browserContainerId, usage)
+
 	var origin string
 	if stat.Config != nil {
 		origin = net.JoinHostPort(stat.Config.Hostname, d.Service.Port)
@@ -234,18 +378,31 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 		Url: u,
 		Container: &session.Container{
 			ID:        browserContainerId,
-			IPAddress: getContainerIP(d.Environment.Network, stat),
+			IPAddress: containerIP,
+			Image:     image.(string),
+			Host:      getHostName(host),
 			Ports:     publishedPortsInfo,
 		},
-		HostPort: hostPort,
-		Origin:   origin,
+		HostPort:       hostPort,
+		Origin:         origin,
+		Proxy:          proxy,
+		Network:        emulateNetwork,
+		Usage:          usage,
+		AttemptTimeout: d.AttemptTimeout,
+		RetryCount:     d.RetryCount,
 		Cancel: func() {
+			stopStats()
 			if videoContainerId != "" {
 				stopVideoContainer(ctx, cl, requestId, videoContainerId, d.Environment)
 			}
+			if enforceEgress {
+				d.EgressProxy.Unregister(containerIP)
+			}
+			defer d.Hosts.Release(host)
+			defer sn.remove(ctx, cl, requestId)
 			defer removeContainer(ctx, cl, requestId, browserContainerId)
 			if d.LogOutputDir != "" && (d.SaveAllLogs || d.Log) {
-				r, err := d.Client.ContainerLogs(ctx, browserContainerId, ctr.LogsOptions{
+				r, err := cl.ContainerLogs(ctx, browserContainerId, ctr.LogsOptions{
 					Timestamps: true,
 					ShowStdout: true,
 					ShowStderr: true,
@@ -269,9 +426,386 @@ func (d *Docker) StartWithCancel() (*StartedService, error) {
 			}
 		},
 	}
+	started = true
 	return &s, nil
 }
 
+type sessionNetwork struct {
+	Name       string
+	containers []string
+	sidecars   []string
+}
+
+func createSessionNetwork(ctx context.Context, cl *client.Client, requestId uint64, internal bool, applicationContainers []string) (*sessionNetwork, error) {
+	name := fmt.Sprintf("selenoid-%s", uuid.New())
+	log.Printf("[%d] [CREATING_NETWORK] [%s]", requestId, name)
+	_, err := cl.NetworkCreate(ctx, name, network.CreateOptions{
+		Driver:   "bridge",
+		Internal: internal,
+		Labels:   map[string]string{"selenoid.request-id": strconv.FormatUint(requestId, 10)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sn := &sessionNetwork{Name: name}
+	for _, applicationContainer := range applicationContainers {
+		pieces := strings.SplitN(applicationContainer, ":", 2)
+		endpoint := &network.EndpointSettings{}
+		if len(pieces) == 2 {
+			endpoint.Aliases = []string{pieces[1]}
+		}
+		err = sn.connect(ctx, cl, pieces[0], endpoint)
+		if err != nil {
+			sn.remove(ctx, cl, requestId)
+			return nil, fmt.Errorf("connect application container %s: %v", pieces[0], err)
+		}
+	}
+	log.Printf("[%d] [NETWORK_CREATED] [%s]", requestId, name)
+	return sn, nil
+}
+
+func (sn *sessionNetwork) connect(ctx context.Context, cl *client.Client, container string, endpoint *network.EndpointSettings) error {
+	err := cl.NetworkConnect(ctx, sn.Name, container, endpoint)
+	if err != nil {
+		return err
+	}
+	sn.containers = append(sn.containers, container)
+	return nil
+}
+
+// Sidecars are limited to the same memory and CPU as browser
+func (sn *sessionNetwork) startSidecar(ctx context.Context, cl *client.Client, requestId uint64, sidecar session.Sidecar, mem int64, cpu int64, timeout time.Duration) error {
+	sidecarStartTime := time.Now()
+	log.Printf("[%d] [CREATING_SIDECAR_CONTAINER] [%s]", requestId, sidecar.Image)
+	sidecarContainer, err := cl.ContainerCreate(ctx,
+		&ctr.Config{
+			Image:  sidecar.Image,
+			Env:    sidecar.Env,
+			Labels: map[string]string{"selenoid.request-id": strconv.FormatUint(requestId, 10)},
+		},
+		&ctr.HostConfig{
+			AutoRemove:  true,
+			NetworkMode: ctr.NetworkMode(sn.Name),
+			Resources: ctr.Resources{
+				Memory:   mem,
+				NanoCPUs: cpu,
+			},
+		},
+		&network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				sn.Name: {Aliases: sidecar.Aliases},
+			},
+		}, nil, "")
+	if err != nil {
+		return fmt.Errorf("create container: %v", err)
+	}
+	sidecarContainerId := sidecarContainer.ID
+	sn.sidecars = append(sn.sidecars, sidecarContainerId)
+	log.Printf("[%d] [STARTING_SIDECAR_CONTAINER] [%s] [%s]", requestId, sidecar.Image, sidecarContainerId)
+	err = cl.ContainerStart(ctx, sidecarContainerId, ctr.StartOptions{})
+	if err != nil {
+		return fmt.Errorf("start container: %v", err)
+	}
+	err = waitContainerReady(ctx, cl, sidecarContainerId, timeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%d] [SIDECAR_CONTAINER_STARTED] [%s] [%s] [%.2fs]", requestId, sidecar.Image, sidecarContainerId, info.SecondsSince(sidecarStartTime))
+	return nil
+}
+
+func waitBrowserReady(ctx context.Context, cl *client.Client, id string, u string, timeout time.Duration, readiness *config.Readiness) error {
+	if readiness != nil && readiness.HealthCheck {
+		start := time.Now()
+		err := waitContainerReady(ctx, cl, id, timeout)
+		if err != nil {
+			return err
+		}
+		timeout -= time.Since(start)
+	}
+	return wait(u, timeout, readiness)
+}
+
+func waitContainerReady(ctx context.Context, cl *client.Client, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		stat, err := cl.ContainerInspect(ctx, id)
+		if err != nil {
+			return fmt.Errorf("inspect container %s: %v", id, err)
+		}
+		if stat.State == nil {
+			return fmt.Errorf("container %s state is unknown", id)
+		}
+		if !stat.State.Running && stat.State.Status != "created" {
+			return fmt.Errorf("container %s is %s", id, stat.State.Status)
+		}
+		health := stat.State.Health
+		switch {
+		case health == nil && stat.State.Running:
+			return nil
+		case health != nil && health.Status == types.Healthy:
+			return nil
+		case health != nil && health.Status == types.Unhealthy:
+			return fmt.Errorf("container %s is unhealthy", id)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container %s is not ready in %v", id, timeout)
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+func (sn *sessionNetwork) remove(ctx context.Context, cl *client.Client, requestId uint64) {
+	if sn == nil {
+		return
+	}
+	for _, sidecar := range sn.sidecars {
+		removeContainer(ctx, cl, requestId, sidecar)
+	}
+	for _, container := range sn.containers {
+		err := cl.NetworkDisconnect(ctx, sn.Name, container, true)
+		if err != nil {
+			log.Printf("[%d] [FAILED_TO_DISCONNECT_CONTAINER] [%s] [%s] [%v]", requestId, sn.Name, container, err)
+		}
+	}
+	log.Printf("[%d] [REMOVING_NETWORK] [%s]", requestId, sn.Name)
+	err := cl.NetworkRemove(ctx, sn.Name)
+	if err != nil {
+		log.Printf("[%d] [FAILED_TO_REMOVE_NETWORK] [%s] [%v]", requestId, sn.Name, err)
+		return
+	}
+	log.Printf("[%d] [NETWORK_REMOVED] [%s]", requestId, sn.Name)
+}
+
+func setNetworkConditions(ctx context.Context, cl *client.Client, requestId uint64, containerId string, conditions *session.Network) error {
+	cmd := getNetemCommand(conditions)
+	log.Printf("[%d] [EMULATING_NETWORK] [%s] [%s]", requestId, containerId, cmd)
+	exec, err := cl.ContainerExecCreate(ctx, containerId, ctr.ExecOptions{
+		User: "root",
+		Cmd:  []string{"sh", "-c", cmd},
+	})
+	if err != nil {
+		return fmt.Errorf("create exec: %v", err)
+	}
+	err = cl.ContainerExecStart(ctx, exec.ID, ctr.ExecStartOptions{})
+	if err != nil {
+		return fmt.Errorf("start exec: %v", err)
+	}
+	deadline := time.Now().Add(networkConditionsTimeout)
+	for {
+		inspect, err := cl.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return fmt.Errorf("inspect exec: %v", err)
+		}
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return fmt.Errorf("tc exited with code %d", inspect.ExitCode)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tc is still running after %v", networkConditionsTimeout)
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+func getNetemCommand(conditions *session.Network) string {
+	var netem []string
+	if conditions.Latency > 0 || conditions.Jitter > 0 {
+		delay := fmt.Sprintf("delay %dms", conditions.Latency)
+		if conditions.Jitter > 0 {
+			delay += fmt.Sprintf(" %dms", conditions.Jitter)
+		}
+		netem = append(netem, delay)
+	}
+	if conditions.Loss > 0 {
+		netem = append(netem, fmt.Sprintf("loss %s%%", strconv.FormatFloat(conditions.Loss, 'f', -1, 64)))
+	}
+	if conditions.Bandwidth > 0 {
+		netem = append(netem, fmt.Sprintf("rate %dkbit", conditions.Bandwidth))
+	}
+	if len(netem) == 0 {
+		return `for dev in $(ls /sys/class/net); do [ "$dev" = lo ] || tc qdisc del dev "$dev" root 2>/dev/null; done; true`
+	}
+	return fmt.Sprintf(`for dev in $(ls /sys/class/net); do [ "$dev" = lo ] || tc qdisc replace dev "$dev" root netem %s || exit 1; done`, strings.Join(netem, " "))
+}
+
+func collectStats(ctx context.Context, cl *client.Client, requestId uint64, containerId string, usage *session.UsageRecorder) {
+	stats, err := cl.ContainerStats(ctx, containerId, true)
+	if err != nil {
+		log.Printf("[%d] [CONTAINER_STATS_ERROR] [%s] [%v]", requestId, containerId, err)
+		return
+	}
+	defer stats.Body.Close()
+	decoder := json.NewDecoder(stats.Body)
+	var prev *ctr.StatsResponse
+	for {
+		var current ctr.StatsResponse
+		err := decoder.Decode(&current)
+		if err != nil {
+			if ctx.Err() == nil && err != io.EOF {
+				log.Printf("[%d] [CONTAINER_STATS_ERROR] [%s] [%v]", requestId, containerId, err)
+			}
+			return
+		}
+		if prev != nil {
+			usage.Add(getUsage(prev, &current))
+		}
+		prev = &current
+	}
+}
+
+func getUsage(prev *ctr.StatsResponse, current *ctr.StatsResponse) session.Usage {
+	u := session.Usage{Memory: current.MemoryStats.Usage}
+	for _, key := range []string{"inactive_file", "total_inactive_file", "cache"} {
+		if cache, ok := current.MemoryStats.Stats[key]; ok && cache < u.Memory {
+			u.Memory -= cache
+			break
+		}
+	}
+	cpuDelta := float64(current.CPUStats.CPUUsage.TotalUsage) - float64(current.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(current.CPUStats.SystemUsage) - float64(current.PreCPUStats.SystemUsage)
+	cpus := float64(current.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(current.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		u.CPU = cpuDelta / systemDelta * cpus * 100
+	}
+	seconds := current.Read.Sub(prev.Read).Seconds()
+	if seconds <= 0 {
+		return u
+	}
+	rate := func(prev, current uint64) uint64 {
+		if current < prev {
+			return 0
+		}
+		return uint64(float64(current-prev) / seconds)
+	}
+	prevRx, prevTx := getNetworkIO(prev)
+	rx, tx := getNetworkIO(current)
+	u.NetworkRx, u.NetworkTx = rate(prevRx, rx), rate(prevTx, tx)
+	prevRead, prevWrite := getBlockIO(prev)
+	read, write := getBlockIO(current)
+	u.BlockRead, u.BlockWrite = rate(prevRead, read), rate(prevWrite, write)
+	return u
+}
+
+func getNetworkIO(stats *ctr.StatsResponse) (uint64, uint64) {
+	var rx, tx uint64
+	for _, n := range stats.Networks {
+		rx += n.RxBytes
+		tx += n.TxBytes
+	}
+	return rx, tx
+}
+
+func getBlockIO(stats *ctr.StatsResponse) (uint64, uint64) {
+	var read, write uint64
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += entry.Value
+		case "write":
+			write += entry.Value
+		}
+	}
+	return read, write
+}
+
+func getHostName(host *DockerHost) string {
+	if host == nil {
+		return ""
+	}
+	return host.Name
+}
+
+func getProxyEnv(proxy string) []string {
+	proxyUrl := "http://" + proxy
+	return []string{
+		"HTTP_PROXY=" + proxyUrl,
+		"HTTPS_PROXY=" + proxyUrl,
+		"http_proxy=" + proxyUrl,
+		"https_proxy=" + proxyUrl,
+		"NO_PROXY=localhost,127.0.0.1",
+		"no_proxy=localhost,127.0.0.1",
+	}
+}
+
+func getNetworkName(name string) string {
+	if name == DefaultContainerNetwork {
+		return "bridge"
+	}
+	return name
+}
+
+var architectures = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"armv6l":  "arm",
+	"i386":    "386",
+	"i686":    "386",
+}
+
+func dockerArchitecture(cl *client.Client) string {
+	if cl == nil {
+		return runtime.GOARCH
+	}
+	info, err := cl.Info(context.Background())
+	if err != nil || info.Architecture == "" {
+		log.Printf("[-] [UNKNOWN_ARCHITECTURE] [Using %s: %v]", runtime.GOARCH, err)
+		return runtime.GOARCH
+	}
+	if arch, ok := architectures[info.Architecture]; ok {
+		return arch
+	}
+	return info.Architecture
+}
+
+// CheckEgressNetwork - make sure that containers attached to egress network can not reach external hosts directly
+func CheckEgressNetwork(ctx context.Context, cl *client.Client, name string) error {
+	inspect, err := cl.NetworkInspect(ctx, name, network.InspectOptions{})
+	if err != nil {
+		return fmt.Errorf("inspect network %s: %v", name, err)
+	}
+	if !inspect.Internal {
+		return fmt.Errorf("network %s is not internal, create it with --internal flag", name)
+	}
+	return nil
+}
+
+func verifyImageDigest(ctx context.Context, cl *client.Client, image string, digest string) error {
+	inspect, _, err := cl.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return fmt.Errorf("inspect image %s: %v", image, err)
+	}
+	if inspect.ID == digest {
+		return nil
+	}
+	for _, repoDigest := range inspect.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s does not match digest %s", image, digest)
+}
+
+// Resources - Consumer interface implementation, sidecars are limited and counted as browser containers
+func (d *Docker) Resources() (int64, int64, error) {
+	mem, err := getMemory(d.ServiceBase, d.Caps, d.Environment)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid memory limit: %v", err)
+	}
+	cpu, err := getCpu(d.ServiceBase, d.Caps, d.Environment)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid CPU limit: %v", err)
+	}
+	containers := int64(1 + len(d.Sidecars))
+	return mem * containers, cpu * containers, nil
+}
+
 func getPortConfig(service *config.Browser, caps session.Caps, env Environment) (*portConfig, error) {
 	selenium, err := nat.NewPort("tcp", service.Port)
 	if err != nil {
@@ -327,6 +861,11 @@ const (
 
 func getLogConfig(logConfig ctr.LogConfig, caps session.Caps) ctr.LogConfig {
 	if logConfig.Config != nil {
+		config := make(map[string]string)
+		for k, v := range logConfig.Config {
+			config[k] = v
+		}
+		logConfig.Config = config
 		_, ok := logConfig.Config[tag]
 		if caps.TestName != "" && !ok {
 			logConfig.Config[tag] = caps.TestName
@@ -374,6 +913,57 @@ func getEnv(service ServiceBase, caps session.Caps) []string {
 	return env
 }
 
+func getUlimits(service *config.Browser) ([]*units.Ulimit, error) {
+	var ulimits []*units.Ulimit
+	for _, ulimit := range service.Ulimits {
+		u, err := units.ParseUlimit(ulimit)
+		if err != nil {
+			return nil, err
+		}
+		ulimits = append(ulimits, u)
+	}
+	return ulimits, nil
+}
+
+func getDevices(service *config.Browser) ([]ctr.DeviceMapping, error) {
+	var devices []ctr.DeviceMapping
+	for _, device := range service.Devices {
+		d, err := parseDevice(device)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+func parseDevice(device string) (ctr.DeviceMapping, error) {
+	pieces := strings.Split(device, ":")
+	if pieces[0] == "" || len(pieces) > 3 {
+		return ctr.DeviceMapping{}, fmt.Errorf("bad device specification: %s", device)
+	}
+	mapping := ctr.DeviceMapping{PathOnHost: pieces[0], PathInContainer: pieces[0], CgroupPermissions: "rwm"}
+	switch len(pieces) {
+	case 2:
+		if isDevicePermissions(pieces[1]) {
+			mapping.CgroupPermissions = pieces[1]
+		} else {
+			mapping.PathInContainer = pieces[1]
+		}
+	case 3:
+		if !isDevicePermissions(pieces[2]) {
+			return ctr.DeviceMapping{}, fmt.Errorf("bad device permissions: %s", device)
+		}
+		mapping.PathInContainer = pieces[1]
+		mapping.CgroupPermissions = pieces[2]
+	}
+	return mapping, nil
+}
+
+func isDevicePermissions(permissions string) bool {
+	return permissions != "" && strings.Trim(permissions, "rwm") == ""
+}
+
 func getShmSize(service *config.Browser) int64 {
 	if service.ShmSize > 0 {
 		return service.ShmSize
@@ -381,28 +971,109 @@ func getShmSize(service *config.Browser) int64 {
 	return int64(268435456)
 }
 
-func getMemory(service *config.Browser, env Environment) (int64, error) {
-	if service.Mem != "" {
-		var mem MemLimit
-		err := mem.Set(service.Mem)
+func getMemory(service ServiceBase, caps session.Caps, env Environment) (int64, error) {
+	mem := MemLimit(env.Memory)
+	if service.Service.Mem != "" {
+		err := mem.Set(service.Service.Mem)
 		if err != nil {
 			return 0, fmt.Errorf("parse memory limit: %v", err)
 		}
+	}
+	if caps.Mem == "" {
 		return int64(mem), nil
 	}
-	return env.Memory, nil
+	maxMem := mem
+	if service.Service.MaxMem != "" {
+		err := maxMem.Set(service.Service.MaxMem)
+		if err != nil {
+			return 0, fmt.Errorf("parse max memory limit: %v", err)
+		}
+	}
+	if maxMem <= 0 {
+		log.Printf("[%d] [MEMORY_LIMIT_IGNORED] [%s]", service.RequestId, caps.Mem)
+		return int64(mem), nil
+	}
+	requested, err := requestedMemory(caps.Mem)
+	if err != nil {
+		return 0, err
+	}
+	if requested > maxMem {
+		log.Printf("[%d] [MEMORY_LIMIT_EXCEEDED] [%s] [%s]", service.RequestId, requested.String(), maxMem.String())
+		return int64(maxMem), nil
+	}
+	return int64(requested), nil
+}
+
+func requestedMemory(s string) (MemLimit, error) {
+	var requested MemLimit
+	err := requested.Set(s)
+	if err != nil {
+		return 0, fmt.Errorf("parse requested memory limit: %v", err)
+	}
+	if requested <= 0 {
+		return 0, fmt.Errorf("requested memory limit should be positive: %s", s)
+	}
+	return requested, nil
 }
 
-func getCpu(service *config.Browser, env Environment) (int64, error) {
-	if service.Cpu != "" {
-		var cpu CpuLimit
-		err := cpu.Set(service.Cpu)
+func getCpu(service ServiceBase, caps session.Caps, env Environment) (int64, error) {
+	cpu := CpuLimit(env.CPU)
+	if service.Service.Cpu != "" {
+		err := cpu.Set(service.Service.Cpu)
 		if err != nil {
 			return 0, fmt.Errorf("parse CPU limit: %v", err)
 		}
+	}
+	if caps.Cpu == "" {
 		return int64(cpu), nil
 	}
-	return env.CPU, nil
+	maxCpu := cpu
+	if service.Service.MaxCpu != "" {
+		err := maxCpu.Set(service.Service.MaxCpu)
+		if err != nil {
+			return 0, fmt.Errorf("parse max CPU limit: %v", err)
+		}
+	}
+	if maxCpu <= 0 {
+		log.Printf("[%d] [CPU_LIMIT_IGNORED] [%s]", service.RequestId, caps.Cpu)
+		return int64(cpu), nil
+	}
+	requested, err := requestedCpu(caps.Cpu)
+	if err != nil {
+		return 0, err
+	}
+	if requested > maxCpu {
+		log.Printf("[%d] [CPU_LIMIT_EXCEEDED] [%s] [%s]", service.RequestId, requested.String(), maxCpu.String())
+		return int64(maxCpu), nil
+	}
+	return int64(requested), nil
+}
+
+func requestedCpu(s string) (CpuLimit, error) {
+	var requested CpuLimit
+	err := requested.Set(s)
+	if err != nil {
+		return 0, fmt.Errorf("parse requested CPU limit: %v", err)
+	}
+	if requested <= 0 {
+		return 0, fmt.Errorf("requested CPU limit should be positive: %s", s)
+	}
+	return requested, nil
+}
+
+// CheckRequestedResources - validates mem and cpu capabilities before looking for a browser
+func CheckRequestedResources(caps session.Caps) error {
+	if caps.Mem != "" {
+		if _, err := requestedMemory(caps.Mem); err != nil {
+			return err
+		}
+	}
+	if caps.Cpu != "" {
+		if _, err := requestedCpu(caps.Cpu); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func getContainerHostname(caps session.Caps) string {
@@ -448,12 +1119,20 @@ func getHostPort(env Environment, servicePort string, caps session.Caps, stat ty
 			}
 		} else {
 			fn = func(containerPort string, port nat.Port) string {
-				return net.JoinHostPort("127.0.0.1", stat.NetworkSettings.Ports[port][0].HostPort)
+				bindings := stat.NetworkSettings.Ports[port]
+				if len(bindings) == 0 {
+					return ""
+				}
+				return net.JoinHostPort("127.0.0.1", bindings[0].HostPort)
 			}
 		}
 	} else {
 		fn = func(containerPort string, port nat.Port) string {
-			return net.JoinHostPort(env.IP, stat.NetworkSettings.Ports[port][0].HostPort)
+			bindings := stat.NetworkSettings.Ports[port]
+			if len(bindings) == 0 {
+				return ""
+			}
+			return net.JoinHostPort(env.IP, bindings[0].HostPort)
 		}
 	}
 	hp := session.HostPort{
@@ -477,7 +1156,9 @@ func getContainerPorts(stat types.ContainerJSON) map[string]string {
 
 	if len(ns.Ports) > 0 {
 		for port, portBindings := range ns.Ports {
-			exposedPorts[port.Port()] = portBindings[0].HostPort
+			if len(portBindings) > 0 {
+				exposedPorts[port.Port()] = portBindings[0].HostPort
+			}
 		}
 	}
 	return exposedPorts
@@ -68,12 +68,12 @@ func (d *Driver) StartWithCancel() (*StartedService, error) {
 	s := time.Now()
 	err = cmd.Start()
 	if err != nil {
-		return nil, fmt.Errorf("cannot start process %v: %v", cmdLine, err)
+		return nil, &StartupFailure{Err: fmt.Errorf("cannot start process %v: %v", cmdLine, err)}
 	}
-	err = wait(u.String(), d.StartupTimeout)
+	err = wait(u.String(), d.StartupTimeout, d.Service.Readiness)
 	if err != nil {
 		d.stopProcess(cmd)
-		return nil, err
+		return nil, &StartupFailure{Err: err, Transient: true}
 	}
 	log.Printf("[%d] [PROCESS_STARTED] [%d] [%.2fs]", requestId, cmd.Process.Pid, info.SecondsSince(s))
 	log.Printf("[%d] [PROXY_TO] [%s]", requestId, u.String())
@@ -81,7 +81,14 @@ func (d *Driver) StartWithCancel() (*StartedService, error) {
 	if d.Caps.VNC {
 		hp.VNC = "127.0.0.1:5900"
 	}
-	return &StartedService{Url: u, HostPort: hp, Origin: fmt.Sprintf("localhost:%s", port), Cancel: func() { d.stopProcess(cmd) }}, nil
+	return &StartedService{
+		Url:            u,
+		HostPort:       hp,
+		Origin:         fmt.Sprintf("localhost:%s", port),
+		AttemptTimeout: d.AttemptTimeout,
+		RetryCount:     d.RetryCount,
+		Cancel:         func() { d.stopProcess(cmd) },
+	}, nil
 }
 
 func (d *Driver) stopProcess(cmd *exec.Cmd) {
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+const maxEventsRetryDelay = 30 * time.Second
+
+// ContainerExit - details of exited container
+type ContainerExit struct {
+	ID        string
+	ExitCode  int
+	OOMKilled bool
+}
+
+// WatchContainers - report exited containers until context is done, current client is taken on every reconnect
+func WatchContainers(ctx context.Context, cl func() *client.Client, onExit func(exit ContainerExit)) {
+	oomKilled := make(map[string]bool)
+	since := time.Now()
+	retryDelay := time.Second
+	for {
+		messages, errs := cl().Events(ctx, events.ListOptions{
+			Since: strconv.FormatInt(since.Unix(), 10),
+			Filters: filters.NewArgs(
+				filters.Arg("type", string(events.ContainerEventType)),
+				filters.Arg("event", string(events.ActionOOM)),
+				filters.Arg("event", string(events.ActionDie)),
+			),
+		})
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-errs:
+				log.Printf("[-] [DOCKER_EVENTS_ERROR] [Retrying in %v: %v]", retryDelay, err)
+				break loop
+			case message := <-messages:
+				retryDelay = time.Second
+				since = time.Unix(0, message.TimeNano)
+				id := message.Actor.ID
+				switch message.Action {
+				case events.ActionOOM:
+					oomKilled[id] = true
+				case events.ActionDie:
+					exitCode, _ := strconv.Atoi(message.Actor.Attributes["exitCode"])
+					onExit(ContainerExit{ID: id, ExitCode: exitCode, OOMKilled: oomKilled[id]})
+					delete(oomKilled, id)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+		retryDelay *= 2
+		if retryDelay > maxEventsRetryDelay {
+			retryDelay = maxEventsRetryDelay
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aerokube/selenoid/config"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+const noneTag = "<none>:<none>"
+
+// ImageCollector - removes old browser images not referenced by configuration or running sessions
+type ImageCollector struct {
+	Config  *config.Config
+	Pattern *regexp.Regexp
+	MaxAge  time.Duration
+	DryRun  bool
+	InUse   func() []string
+
+	lock sync.Mutex
+}
+
+// Collect - remove unused images matching pattern
+func (c *ImageCollector) Collect(ctx context.Context, cl *client.Client) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	images, err := cl.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		log.Printf("[-] [IMAGE_GC_ERROR] [Failed to list images: %v]", err)
+		return
+	}
+	keep := make(map[string]bool)
+	for _, name := range c.Config.Images() {
+		keep[normalizeImageName(name)] = true
+	}
+	if c.InUse != nil {
+		for _, name := range c.InUse() {
+			keep[normalizeImageName(name)] = true
+		}
+	}
+	for _, img := range images {
+		if time.Since(time.Unix(img.Created, 0)) < c.MaxAge || referenced(img, keep) {
+			continue
+		}
+		for _, tag := range img.RepoTags {
+			if tag == noneTag || keep[tag] || !c.Pattern.MatchString(tag) {
+				continue
+			}
+			if c.DryRun {
+				log.Printf("[-] [IMAGE_GC_DRY_RUN] [Would remove %s]", tag)
+				continue
+			}
+			_, err := cl.ImageRemove(ctx, tag, image.RemoveOptions{PruneChildren: true})
+			if err != nil {
+				log.Printf("[-] [IMAGE_GC_ERROR] [Failed to remove %s: %v]", tag, err)
+				continue
+			}
+			log.Printf("[-] [IMAGE_GC_REMOVED] [%s]", tag)
+		}
+	}
+}
+
+// Removing the last tag also removes digest references, so images pinned by ID or digest are kept with all tags
+func referenced(img image.Summary, keep map[string]bool) bool {
+	if keep[img.ID] {
+		return true
+	}
+	for _, repoDigest := range img.RepoDigests {
+		_, digest, _ := strings.Cut(repoDigest, "@")
+		if keep[repoDigest] || keep[digest] {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeImageName(name string) string {
+	if strings.Contains(name, "@") || strings.LastIndex(name, ":") > strings.LastIndex(name, "/") {
+		return name
+	}
+	return name + ":latest"
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aerokube/selenoid/config"
+	"github.com/docker/docker/client"
+)
+
+// DockerHealth - tracks Docker daemon availability and reconnects after daemon restarts
+type DockerHealth struct {
+	lock    sync.RWMutex
+	client  *client.Client
+	connect func() (*client.Client, error)
+	state   config.DockerState
+	err     error
+}
+
+// NewDockerHealth - start tracking Docker daemon, connect is used to create a new client after restarts
+func NewDockerHealth(cl *client.Client, connect func() (*client.Client, error)) *DockerHealth {
+	return &DockerHealth{
+		client:  cl,
+		connect: connect,
+		state:   config.DockerState{Healthy: true, Since: time.Now()},
+	}
+}
+
+// Client - current Docker client
+func (h *DockerHealth) Client() *client.Client {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.client
+}
+
+// Err - reason why Docker daemon is not available
+func (h *DockerHealth) Err() error {
+	if h == nil {
+		return nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.err
+}
+
+// State - current Docker daemon state
+func (h *DockerHealth) State() *config.DockerState {
+	if h == nil {
+		return nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	state := h.state
+	return &state
+}
+
+// Check - ping Docker daemon and reconnect when it is back or its API version changed
+func (h *DockerHealth) Check(ctx context.Context, timeout time.Duration) {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ping, err := h.Client().Ping(pingCtx)
+	if err != nil {
+		h.setUnhealthy(err)
+		return
+	}
+	state := h.State()
+	if state.Healthy && state.APIVersion == ping.APIVersion {
+		return
+	}
+	cl := h.Client()
+	if state.APIVersion != "" {
+		cl, err = h.connect()
+		if err != nil {
+			h.setUnhealthy(err)
+			return
+		}
+		log.Printf("[-] [DOCKER_RECONNECTED] [Server API version %s, client API version %s]", ping.APIVersion, cl.ClientVersion())
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.state.Healthy {
+		log.Printf("[-] [DOCKER_AVAILABLE]")
+		h.state.Since = time.Now()
+	}
+	if h.client != cl {
+		// Only idle connections are closed, requests in progress complete normally
+		_ = h.client.Close()
+	}
+	h.client = cl
+	h.err = nil
+	h.state.Healthy = true
+	h.state.APIVersion = ping.APIVersion
+	h.state.Error = ""
+}
+
+func (h *DockerHealth) setUnhealthy(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.state.Healthy {
+		log.Printf("[-] [DOCKER_UNAVAILABLE] [%v]", err)
+		h.state.Since = time.Now()
+	}
+	h.err = fmt.Errorf("docker daemon is not available: %v", err)
+	h.state.Healthy = false
+	h.state.Error = err.Error()
+}
+
+// Watch - periodically check Docker daemon until context is done
+func (h *DockerHealth) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.Check(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
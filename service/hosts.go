@@ -0,0 +1,269 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aerokube/selenoid/config"
+	"github.com/docker/docker/client"
+)
+
+// DockerHostConfig - Docker endpoint description from hosts file
+type DockerHostConfig struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	IP       string `json:"ip"`
+	Capacity int    `json:"capacity"`
+	CertPath string `json:"certPath,omitempty"`
+}
+
+// DockerHost - Docker endpoint browser containers can be placed on
+type DockerHost struct {
+	Name     string
+	IP       string
+	Capacity int
+	Client   *client.Client
+	// Local - whether host shares filesystem with Selenoid (e.g. Unix socket)
+	Local bool
+
+	used    int
+	healthy bool
+}
+
+// Hosts - pool of Docker hosts sessions are distributed across
+type Hosts struct {
+	lock  sync.Mutex
+	hosts []*DockerHost
+}
+
+// NewHosts - create pool of initially healthy Docker hosts
+func NewHosts(hosts ...*DockerHost) *Hosts {
+	for _, host := range hosts {
+		host.healthy = true
+	}
+	return &Hosts{hosts: hosts}
+}
+
+// LoadHosts - create pool of Docker hosts from JSON file
+func LoadHosts(filename string) (*Hosts, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read error: %v", err)
+	}
+	var configs []DockerHostConfig
+	if err := json.Unmarshal(buf, &configs); err != nil {
+		return nil, fmt.Errorf("parse error: %v", err)
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no Docker hosts specified")
+	}
+	names := make(map[string]bool)
+	var hosts []*DockerHost
+	for _, cfg := range configs {
+		host, err := newDockerHost(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("docker host %s: %v", cfg.Host, err)
+		}
+		if names[host.Name] {
+			return nil, fmt.Errorf("duplicate Docker host name: %s", host.Name)
+		}
+		names[host.Name] = true
+		hosts = append(hosts, host)
+	}
+	return NewHosts(hosts...), nil
+}
+
+func newDockerHost(cfg DockerHostConfig) (*DockerHost, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("host is required")
+	}
+	if cfg.Capacity <= 0 {
+		return nil, fmt.Errorf("capacity should be positive: %d", cfg.Capacity)
+	}
+	u, err := client.ParseHostURL(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	ip := cfg.IP
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(u.Host)
+	}
+	name := cfg.Name
+	if name == "" {
+		name = cfg.Host
+	}
+	opts := []client.Opt{client.WithHost(cfg.Host), client.WithAPIVersionNegotiation()}
+	if cfg.CertPath != "" {
+		opts = append(opts, client.WithTLSClientConfig(
+			filepath.Join(cfg.CertPath, "ca.pem"),
+			filepath.Join(cfg.CertPath, "cert.pem"),
+			filepath.Join(cfg.CertPath, "key.pem"),
+		))
+	}
+	cl, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DockerHost{Name: name, IP: ip, Capacity: cfg.Capacity, Client: cl, Local: isLocalHost(u.Scheme, u.Host)}, nil
+}
+
+func isLocalHost(scheme string, addr string) bool {
+	if scheme == "unix" || scheme == "npipe" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Default - client of the first Docker host
+func (h *Hosts) Default() *client.Client {
+	return h.hosts[0].Client
+}
+
+// Clients - clients of all Docker hosts
+func (h *Hosts) Clients() []*client.Client {
+	var clients []*client.Client
+	for _, host := range h.hosts {
+		clients = append(clients, host.Client)
+	}
+	return clients
+}
+
+// Client - get client of Docker host by name
+func (h *Hosts) Client(name string) (*client.Client, bool) {
+	if h == nil {
+		return nil, false
+	}
+	for _, host := range h.hosts {
+		if host.Name == name {
+			return host.Client, true
+		}
+	}
+	return nil, false
+}
+
+// Architecture - browsers architecture common to all Docker hosts
+func (h *Hosts) Architecture() (string, error) {
+	arch := ""
+	for _, host := range h.hosts {
+		hostArch := dockerArchitecture(host.Client)
+		if arch != "" && hostArch != arch {
+			return "", fmt.Errorf("docker host %s has %s architecture while other hosts have %s", host.Name, hostArch, arch)
+		}
+		arch = hostArch
+	}
+	return arch, nil
+}
+
+// Acquire - reserve a slot on the least loaded healthy host preferring hosts having the image
+func (h *Hosts) Acquire(ctx context.Context, image string) (*DockerHost, error) {
+	h.lock.Lock()
+	var candidates []*DockerHost
+	for _, host := range h.hosts {
+		if host.healthy && host.used < host.Capacity {
+			candidates = append(candidates, host)
+		}
+	}
+	h.lock.Unlock()
+	var withImage []*DockerHost
+	for _, host := range candidates {
+		if _, _, err := host.Client.ImageInspectWithRaw(ctx, image); err == nil {
+			withImage = append(withImage, host)
+		}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	host := leastLoaded(withImage)
+	if host == nil {
+		host = leastLoaded(candidates)
+	}
+	if host == nil {
+		return nil, errors.New("no Docker host has free capacity")
+	}
+	host.used++
+	return host, nil
+}
+
+func leastLoaded(hosts []*DockerHost) *DockerHost {
+	var ret *DockerHost
+	for _, host := range hosts {
+		if !host.healthy || host.used >= host.Capacity {
+			continue
+		}
+		if ret == nil || host.used*ret.Capacity < ret.used*host.Capacity {
+			ret = host
+		}
+	}
+	return ret
+}
+
+// Release - return slot reserved on Docker host
+func (h *Hosts) Release(host *DockerHost) {
+	if h == nil || host == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	host.used--
+}
+
+// Watch - periodically check that Docker hosts are available
+func (h *Hosts) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, host := range h.hosts {
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			_, err := host.Client.Ping(pingCtx)
+			cancel()
+			h.lock.Lock()
+			if err != nil && host.healthy {
+				log.Printf("[-] [DOCKER_HOST_UNHEALTHY] [%s] [%v]", host.Name, err)
+			} else if err == nil && !host.healthy {
+				log.Printf("[-] [DOCKER_HOST_HEALTHY] [%s]", host.Name)
+			}
+			host.healthy = err == nil
+			h.lock.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// State - get usage of Docker hosts
+func (h *Hosts) State() []config.HostState {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var state []config.HostState
+	for _, host := range h.hosts {
+		state = append(state, config.HostState{
+			Name:     host.Name,
+			IP:       host.IP,
+			Capacity: host.Capacity,
+			Used:     host.used,
+			Healthy:  host.healthy,
+		})
+	}
+	return state
+}
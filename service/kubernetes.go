@@ -1,12 +1,17 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -14,15 +19,27 @@ import (
 	"log"
 
 	"dario.cat/mergo"
+	"github.com/aerokube/selenoid/info"
 	"github.com/aerokube/selenoid/session"
 	"github.com/google/uuid"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	browserContainerName = "browser"
+	videoContainerName   = "video-recorder"
+	videoVolumeName      = "video"
+	podVideoDir          = "/video"
 )
 
 type Kubernetes struct {
@@ -61,63 +78,69 @@ func (k *Kubernetes) StartWithCancel() (*StartedService, error) {
 	if err != nil {
 		return nil, err
 	}
-	podDefault := k.constructSelenoidRequestPod(name, selenoidOwnerReference, uuid, env, statusURL)
+	resources, err := k.getResources()
+	if err != nil {
+		return nil, err
+	}
+	podDefault := k.constructSelenoidRequestPod(name, selenoidOwnerReference, uuid, env, statusURL, resources)
 	if err := mergo.Merge(pod, podDefault); err != nil {
 		return nil, err
 	}
+	k.addVideoRecorder(pod)
 	pod, err = podClient.Create(context.Background(), pod, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
 	name = pod.Name
-POD_READY:
-	for {
-		log.Printf("[KUBERNETES_BACKEND] Waiting for the pod to be ready")
-		time.Sleep(10 * time.Second)
-		pod, err = podClient.Get(context.Background(), pod.Name, metav1.GetOptions{})
-		if err != nil {
-			log.Print(err)
-		}
-		for _, condition := range pod.Status.Conditions {
-			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
-				break POD_READY
-			}
+	log.Printf("[%d] [POD_CREATED] [%s]", k.RequestId, name)
+	podStartTime := time.Now()
+	pod, err = k.waitPodReady(clientset, pod)
+	if err != nil {
+		log.Printf("[%d] [POD_STARTUP_FAILED] [%s] [%v]", k.RequestId, name, err)
+		diagnostics := k.podDiagnostics(clientset, pod)
+		k.deletePod(clientset, name)
+		if len(diagnostics) > 0 {
+			return nil, &StartupFailure{Err: fmt.Errorf("pod %s is not ready: %v: %s", name, err, strings.Join(diagnostics, "; "))}
 		}
+		return nil, &StartupFailure{Err: fmt.Errorf("pod %s is not ready: %v", name, err), Transient: true}
 	}
-	log.Printf("[KUBERNETES_BACKEND] Pod is ready")
+	log.Printf("[%d] [POD_READY] [%s] [%.2fs]", k.RequestId, name, info.SecondsSince(podStartTime))
 
 	svcClient := clientset.CoreV1().Services(k.BrowserNamespace)
 	service := k.constructSelenoidService(name, pod, uuid)
-
-	_, err = svcClient.Create(context.Background(), service, metav1.CreateOptions{})
-	if err != nil {
-		return nil, err
-	}
-	// Wait until pod is running
-	podUpdated, err := clientset.CoreV1().Pods(k.BrowserNamespace).Get(context.Background(), name, metav1.GetOptions{})
-	svcUpdated, err := clientset.CoreV1().Services(k.BrowserNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	svc, err := svcClient.Create(context.Background(), service, metav1.CreateOptions{})
 	if err != nil {
-		return nil, err
+		k.deletePod(clientset, name)
+		return nil, fmt.Errorf("create service: %v", err)
 	}
-	// Create a pod
-	// Create a service
-	// Wait until pod is ready
-	// Define the StartedService
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", name, k.BrowserNamespace)
 	hp := session.HostPort{
-		Selenium: net.JoinHostPort(fmt.Sprintf("%s.%s.svc.cluster.local", name, k.BrowserNamespace), "4444"),
+		Selenium:   net.JoinHostPort(host, "4444"),
+		Fileserver: net.JoinHostPort(host, ports.Fileserver),
+		Clipboard:  net.JoinHostPort(host, ports.Clipboard),
+		Devtools:   net.JoinHostPort(host, ports.Devtools),
+	}
+	if k.Caps.VNC {
+		hp.VNC = net.JoinHostPort(host, ports.VNC)
 	}
 	u := &url.URL{Scheme: "http", Host: hp.Selenium, Path: k.Service.Path}
 	s := StartedService{
 		Url:    u,
-		Origin: net.JoinHostPort(fmt.Sprintf("%s.selenoid.svc.cluster.local", name), "4444"),
+		Origin: hp.Selenium,
 		Container: &session.Container{
-			ID:        string(podUpdated.ObjectMeta.GetUID()),
-			IPAddress: svcUpdated.Spec.ClusterIP,
+			ID:        string(pod.ObjectMeta.GetUID()),
+			IPAddress: svc.Spec.ClusterIP,
+			Image:     k.Service.Image.(string),
 			Ports:     map[string]string{"4444": "4444"},
 		},
-		HostPort: hp,
+		Logs: func(ctx context.Context) (io.ReadCloser, error) {
+			return podClient.GetLogs(pod.Name, &corev1.PodLogOptions{Container: browserContainerName, Follow: true}).Stream(ctx)
+		},
+		HostPort:       hp,
+		AttemptTimeout: k.AttemptTimeout,
+		RetryCount:     k.RetryCount,
 		Cancel: func() {
-			if err := k.Cancel(context.Background(), k.RequestId, podUpdated.Name, svcUpdated.Name); err != nil {
+			if err := k.Cancel(context.Background(), k.RequestId, pod.Name, svc.Name); err != nil {
 				log.Printf("[KUBERNETES_ERROR] %s", err)
 			}
 		},
@@ -125,6 +148,137 @@ POD_READY:
 	return &s, nil
 }
 
+const podWatchRetryDelay = 500 * time.Millisecond
+
+var podFailureReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CrashLoopBackOff":           true,
+}
+
+func (k *Kubernetes) waitPodReady(clientset kubernetes.Interface, pod *corev1.Pod) (*corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.StartupTimeout)
+	defer cancel()
+	podClient := clientset.CoreV1().Pods(k.BrowserNamespace)
+	resourceVersion := pod.ResourceVersion
+	for {
+		if ready, err := podReady(pod); ready || err != nil {
+			return pod, err
+		}
+		w, err := podClient.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", pod.Name).String(),
+			ResourceVersion: resourceVersion,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return pod, fmt.Errorf("not ready in %v", k.StartupTimeout)
+			}
+			return pod, fmt.Errorf("watch pod: %v", err)
+		}
+		expired := false
+	events:
+		for event := range w.ResultChan() {
+			switch event.Type {
+			case watch.Deleted:
+				w.Stop()
+				return pod, errors.New("pod was deleted")
+			case watch.Error:
+				expired = true
+				break events
+			}
+			updated, ok := event.Object.(*corev1.Pod)
+			if !ok {
+				continue
+			}
+			pod, resourceVersion = updated, updated.ResourceVersion
+			if ready, err := podReady(pod); ready || err != nil {
+				w.Stop()
+				return pod, err
+			}
+		}
+		w.Stop()
+		select {
+		case <-ctx.Done():
+			return pod, fmt.Errorf("not ready in %v", k.StartupTimeout)
+		case <-time.After(podWatchRetryDelay):
+		}
+		if expired {
+			// Changes after watched resource version are lost, so watch again from current pod state
+			updated, err := podClient.Get(ctx, pod.Name, metav1.GetOptions{})
+			if err != nil {
+				if ctx.Err() != nil {
+					return pod, fmt.Errorf("not ready in %v", k.StartupTimeout)
+				}
+				return pod, fmt.Errorf("get pod: %v", err)
+			}
+			pod, resourceVersion = updated, updated.ResourceVersion
+		}
+	}
+}
+
+func podReady(pod *corev1.Pod) (bool, error) {
+	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+		return false, fmt.Errorf("pod is %s", pod.Status.Phase)
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && podFailureReasons[waiting.Reason] {
+			return false, fmt.Errorf("container %s is in %s state", status.Name, waiting.Reason)
+		}
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Pod conditions, container statuses and warning events explaining why pod is not ready
+func (k *Kubernetes) podDiagnostics(clientset kubernetes.Interface, pod *corev1.Pod) []string {
+	var diagnostics []string
+	for _, condition := range pod.Status.Conditions {
+		if condition.Status == corev1.ConditionFalse && condition.Reason != "" {
+			diagnostics = append(diagnostics, fmt.Sprintf("%s: %s %s", condition.Type, condition.Reason, condition.Message))
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil {
+			diagnostics = append(diagnostics, fmt.Sprintf("container %s waiting: %s %s", status.Name, waiting.Reason, waiting.Message))
+		}
+		if terminated := status.LastTerminationState.Terminated; terminated != nil {
+			diagnostics = append(diagnostics, fmt.Sprintf("container %s terminated: %s exit code %d", status.Name, terminated.Reason, terminated.ExitCode))
+		}
+		if terminated := status.State.Terminated; terminated != nil {
+			diagnostics = append(diagnostics, fmt.Sprintf("container %s terminated: %s exit code %d", status.Name, terminated.Reason, terminated.ExitCode))
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events, err := clientset.CoreV1().Events(k.BrowserNamespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.Set{"involvedObject.kind": "Pod", "involvedObject.name": pod.Name}.String(),
+	})
+	if err != nil {
+		log.Printf("[%d] [KUBERNETES_ERROR] [Failed to list pod %s events: %v]", k.RequestId, pod.Name, err)
+		return diagnostics
+	}
+	for _, event := range events.Items {
+		if event.Type == corev1.EventTypeWarning {
+			diagnostics = append(diagnostics, fmt.Sprintf("%s: %s", event.Reason, event.Message))
+		}
+	}
+	return diagnostics
+}
+
+func (k *Kubernetes) deletePod(clientset kubernetes.Interface, name string) {
+	log.Printf("[%d] [DELETING_POD] [%s]", k.RequestId, name)
+	err := clientset.CoreV1().Pods(k.BrowserNamespace).Delete(context.Background(), name, *metav1.NewDeleteOptions(0))
+	if err != nil {
+		log.Printf("[%d] [KUBERNETES_ERROR] [Failed to delete pod %s: %v]", k.RequestId, name, err)
+	}
+}
+
 func (k *Kubernetes) constructSelenoidService(name string, pod *corev1.Pod, reqID string) *corev1.Service {
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -189,7 +343,8 @@ func readEnvOrDefault(env, fallback string) string {
 	return fallback
 }
 
-func (k *Kubernetes) constructSelenoidRequestPod(name string, ownerRef []metav1.OwnerReference, reqID string, env []corev1.EnvVar, statusURL string) corev1.Pod {
+// Per-session mem and cpu capabilities replace both request and limit
+func (k *Kubernetes) getResources() (corev1.ResourceRequirements, error) {
 	memoryLimit := readEnvOrDefault("SELENOID_BROWSER_MEMORY_LIMIT", "1500Mi")
 	memoryRequest := readEnvOrDefault("SELENOID_BROWSER_MEMORY_REQUEST", "1500Mi")
 	cpuLimit := readEnvOrDefault("SELENOID_BROWSER_CPU_LIMIT", "")
@@ -213,7 +368,33 @@ func (k *Kubernetes) constructSelenoidRequestPod(name string, ownerRef []metav1.
 		resources.Requests[corev1.ResourceCPU] = resource.MustParse(cpuRequest)
 	}
 
-	return corev1.Pod{
+	if k.Caps.Mem != "" {
+		mem, err := getMemory(k.ServiceBase, k.Caps, k.Environment)
+		if err != nil {
+			return resources, fmt.Errorf("invalid memory limit: %v", err)
+		}
+		if mem > 0 {
+			quantity := *resource.NewQuantity(mem, resource.BinarySI)
+			resources.Limits[corev1.ResourceMemory] = quantity
+			resources.Requests[corev1.ResourceMemory] = quantity
+		}
+	}
+	if k.Caps.Cpu != "" {
+		cpu, err := getCpu(k.ServiceBase, k.Caps, k.Environment)
+		if err != nil {
+			return resources, fmt.Errorf("invalid CPU limit: %v", err)
+		}
+		if cpu > 0 {
+			quantity := *resource.NewMilliQuantity(cpu/1000000, resource.DecimalSI)
+			resources.Limits[corev1.ResourceCPU] = quantity
+			resources.Requests[corev1.ResourceCPU] = quantity
+		}
+	}
+	return resources, nil
+}
+
+func (k *Kubernetes) constructSelenoidRequestPod(name string, ownerRef []metav1.OwnerReference, reqID string, env []corev1.EnvVar, statusURL string, resources corev1.ResourceRequirements) corev1.Pod {
+	pod := corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: name,
 			Labels: map[string]string{
@@ -234,7 +415,7 @@ func (k *Kubernetes) constructSelenoidRequestPod(name string, ownerRef []metav1.
 			},
 			Containers: []corev1.Container{
 				{
-					Name:  "browser",
+					Name:  browserContainerName,
 					Image: k.Service.Image.(string),
 					Env:   env,
 					VolumeMounts: []corev1.VolumeMount{
@@ -264,9 +445,9 @@ func (k *Kubernetes) constructSelenoidRequestPod(name string, ownerRef []metav1.
 						},
 					},
 					ReadinessProbe: &corev1.Probe{
-						InitialDelaySeconds: 20,
+						InitialDelaySeconds: 1,
 						TimeoutSeconds:      10,
-						PeriodSeconds:       10,
+						PeriodSeconds:       1,
 						FailureThreshold:    20,
 						ProbeHandler: corev1.ProbeHandler{
 							HTTPGet: &corev1.HTTPGetAction{
@@ -279,6 +460,132 @@ func (k *Kubernetes) constructSelenoidRequestPod(name string, ownerRef []metav1.
 			},
 		},
 	}
+	return pod
+}
+
+// Merging does not extend non-empty slices from pod template, so recorder is added to merged pod
+func (k *Kubernetes) addVideoRecorder(pod *corev1.Pod) {
+	if !k.Caps.Video || len(pod.Spec.Containers) == 0 {
+		return
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         videoVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	browser := &pod.Spec.Containers[0]
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == browserContainerName {
+			browser = &pod.Spec.Containers[i]
+			break
+		}
+	}
+	browser.VolumeMounts = append(browser.VolumeMounts, corev1.VolumeMount{Name: videoVolumeName, MountPath: podVideoDir})
+	pod.Spec.Containers = append(pod.Spec.Containers, k.videoRecorderContainer())
+	if pod.Spec.RestartPolicy == "" {
+		// Restarted recorder would overwrite video before it is copied
+		pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+}
+
+func (k *Kubernetes) videoRecorderContainer() corev1.Container {
+	env := []corev1.EnvVar{
+		{Name: "TZ", Value: getTimeZone(k.ServiceBase, k.Caps).String()},
+		{Name: "FILE_NAME", Value: k.Caps.VideoName},
+		{Name: "BROWSER_CONTAINER_NAME", Value: "localhost"},
+	}
+	if k.Caps.VideoCodec != "" {
+		env = append(env, corev1.EnvVar{Name: "CODEC", Value: k.Caps.VideoCodec})
+	}
+	if k.Caps.VideoScreenSize != "" {
+		env = append(env, corev1.EnvVar{Name: "VIDEO_SIZE", Value: k.Caps.VideoScreenSize})
+	}
+	if k.Caps.VideoFrameRate > 0 {
+		env = append(env, corev1.EnvVar{Name: "FRAME_RATE", Value: strconv.FormatUint(uint64(k.Caps.VideoFrameRate), 10)})
+	}
+	return corev1.Container{
+		Name:  videoContainerName,
+		Image: k.VideoContainerImage,
+		Env:   env,
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: videoVolumeName, MountPath: "/data"},
+		},
+	}
+}
+
+// Stop video recorder and copy recorded file from shared pod volume to video output dir
+func (k *Kubernetes) saveVideo(ctx context.Context, clientset kubernetes.Interface, podName string) {
+	requestId := k.RequestId
+	log.Printf("[%d] [STOPPING_VIDEO_CONTAINER] [%s]", requestId, podName)
+	err := k.exec(ctx, clientset, podName, videoContainerName, []string{"kill", "-TERM", "1"}, io.Discard)
+	if err != nil {
+		log.Printf("[%d] [FAILED_TO_STOP_VIDEO_CONTAINER] [%s] [%v]", requestId, podName, err)
+		return
+	}
+	err = k.waitContainerTerminated(ctx, clientset, podName, videoContainerName)
+	if err != nil {
+		log.Printf("[%d] [FAILED_TO_STOP_VIDEO_CONTAINER] [%s] [%v]", requestId, podName, err)
+		return
+	}
+	log.Printf("[%d] [STOPPED_VIDEO_CONTAINER] [%s]", requestId, podName)
+	filename := filepath.Join(k.VideoOutputDir, k.Caps.VideoName)
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Printf("[%d] [VIDEO_ERROR] [Failed to create video file %s: %v]", requestId, filename, err)
+		return
+	}
+	defer f.Close()
+	err = k.exec(ctx, clientset, podName, browserContainerName, []string{"cat", path.Join(podVideoDir, k.Caps.VideoName)}, f)
+	if err != nil {
+		log.Printf("[%d] [VIDEO_ERROR] [Failed to copy video from pod %s: %v]", requestId, podName, err)
+		_ = os.Remove(filename)
+	}
+}
+
+func (k *Kubernetes) waitContainerTerminated(ctx context.Context, clientset kubernetes.Interface, podName string, containerName string) error {
+	ctx, cancel := context.WithTimeout(ctx, k.SessionDeleteTimeout)
+	defer cancel()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pod, err := clientset.CoreV1().Pods(k.BrowserNamespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == containerName && status.State.Terminated != nil {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("container %s is still running after %v", containerName, k.SessionDeleteTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *Kubernetes) exec(ctx context.Context, clientset kubernetes.Interface, podName string, containerName string, cmd []string, stdout io.Writer) error {
+	req := clientset.CoreV1().RESTClient().Post().
+		Namespace(k.BrowserNamespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   cmd,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(k.Client, http.MethodPost, req.URL())
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: stdout, Stderr: &stderr})
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return err
 }
 
 func (k *Kubernetes) Cancel(ctx context.Context, requestID uint64, podName, serviceName string) error {
@@ -287,6 +594,9 @@ func (k *Kubernetes) Cancel(ctx context.Context, requestID uint64, podName, serv
 	if err != nil {
 		return err
 	}
+	if k.Caps.Video {
+		k.saveVideo(ctx, clientset, podName)
+	}
 	podClient := clientset.CoreV1().Pods(k.BrowserNamespace)
 	if err := podClient.Delete(ctx, podName, *metav1.NewDeleteOptions(60)); err != nil {
 		return err
@@ -1,14 +1,22 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aerokube/selenoid/config"
+	"github.com/aerokube/selenoid/egress"
 	"github.com/aerokube/selenoid/session"
 	"github.com/docker/docker/client"
 	"k8s.io/client-go/rest"
@@ -23,6 +31,8 @@ type Environment struct {
 	Network              string
 	Hostname             string
 	StartupTimeout       time.Duration
+	AttemptTimeout       time.Duration
+	RetryCount           int
 	SessionDeleteTimeout time.Duration
 	CaptureDriverLogs    bool
 	VideoOutputDir       string
@@ -30,6 +40,9 @@ type Environment struct {
 	LogOutputDir         string
 	SaveAllLogs          bool
 	Privileged           bool
+	EgressNetwork        string
+	EgressProxyAddr      string
+	EgressProxy          *egress.Proxy
 }
 
 const (
@@ -42,6 +55,14 @@ type ServiceBase struct {
 	Service   *config.Browser
 }
 
+// FallbackVersions - browser versions to try when service fails to start
+func (sb ServiceBase) FallbackVersions() []string {
+	if sb.Service == nil {
+		return nil
+	}
+	return sb.Service.Fallback
+}
+
 // StartedService - all started service properties
 type StartedService struct {
 	Url       *url.URL
@@ -49,6 +70,36 @@ type StartedService struct {
 	HostPort  session.HostPort
 	Origin    string
 	Cancel    func()
+	Proxy     string
+	Network   func(network *session.Network) error
+	Usage     *session.UsageRecorder
+	Logs      func(ctx context.Context) (io.ReadCloser, error)
+
+	AttemptTimeout time.Duration
+	RetryCount     int
+}
+
+// StartupFailure - browser container, pod or driver failed to start by itself,
+// unlike invalid requests or exhausted capacity such failures are counted by startup breaker
+type StartupFailure struct {
+	Err       error
+	Transient bool
+}
+
+func (f *StartupFailure) Error() string {
+	return f.Err.Error()
+}
+
+// IsStartupFailure - whether error is caused by browser itself
+func IsStartupFailure(err error) bool {
+	var failure *StartupFailure
+	return errors.As(err, &failure)
+}
+
+// IsTransient - whether starting browser again may succeed, e.g. after port race or readiness timeout
+func IsTransient(err error) bool {
+	var failure *StartupFailure
+	return errors.As(err, &failure) && failure.Transient
 }
 
 // Starter - interface to create session with cancellation ability
@@ -56,6 +107,16 @@ type Starter interface {
 	StartWithCancel() (*StartedService, error)
 }
 
+// Fallback - starter having fallback browser versions
+type Fallback interface {
+	FallbackVersions() []string
+}
+
+// Consumer - starter knowing memory and CPU its service is limited to
+type Consumer interface {
+	Resources() (int64, int64, error)
+}
+
 // Manager - interface to choose appropriate starter
 type Manager interface {
 	Find(caps session.Caps, requestId uint64) (Starter, bool)
@@ -65,7 +126,36 @@ type Manager interface {
 type DefaultManager struct {
 	Environment *Environment
 	Client      *client.Client
+	Hosts       *Hosts
+	Health      *DockerHealth
 	Config      *config.Config
+
+	archOnce sync.Once
+	arch     string
+}
+
+// Architecture - browsers host architecture in GOARCH format
+func (m *DefaultManager) Architecture() string {
+	m.archOnce.Do(func() {
+		if m.Hosts == nil {
+			m.arch = dockerArchitecture(m.Client)
+			return
+		}
+		arch, err := m.Hosts.Architecture()
+		if err != nil {
+			log.Printf("[-] [UNKNOWN_ARCHITECTURE] [Using %s: %v]", runtime.GOARCH, err)
+			arch = runtime.GOARCH
+		}
+		m.arch = arch
+	})
+	return m.arch
+}
+
+func (m *DefaultManager) client() *client.Client {
+	if m.Health != nil {
+		return m.Health.Client()
+	}
+	return m.Client
 }
 
 // Find - default implementation Manager interface
@@ -74,16 +164,54 @@ func (m *DefaultManager) Find(caps session.Caps, requestId uint64) (Starter, boo
 	version := caps.Version
 	log.Printf("[%d] [LOCATING_SERVICE] [%s] [%s]", requestId, browserName, version)
 	service, version, ok := m.Config.Find(browserName, version)
-	serviceBase := ServiceBase{RequestId: requestId, Service: service}
 	if !ok {
 		return nil, false
 	}
+	arch := m.Architecture()
+	image, ok := service.ImageFor(arch)
+	if !ok {
+		log.Printf("[%d] [UNSUPPORTED_ARCHITECTURE] [%s] [%s] [%s]", requestId, browserName, version, arch)
+		return nil, false
+	}
+	if caps.Image != "" {
+		if err := CheckCustomImage(service, image, browserName, version, caps.Image); err != nil {
+			log.Printf("[%d] [IMAGE_NOT_ALLOWED] [%s] [%s] [%v]", requestId, browserName, version, err)
+			return nil, false
+		}
+		log.Printf("[%d] [USING_CUSTOM_IMAGE] [%s] [%s] [%s]", requestId, browserName, version, caps.Image)
+		resolved := *service
+		resolved.Image = caps.Image
+		resolved.Digest = ""
+		service = &resolved
+	} else if _, ok := service.Image.(map[string]interface{}); ok {
+		resolved := *service
+		resolved.Image = image
+		service = &resolved
+	}
+	if len(caps.Sidecars) > 0 && !areSidecarsAllowed(service, image, caps.Sidecars) {
+		log.Printf("[%d] [SIDECAR_NOT_ALLOWED] [%s] [%s]", requestId, browserName, version)
+		return nil, false
+	}
+	serviceBase := ServiceBase{RequestId: requestId, Service: service}
+	env := browserEnvironment(*m.Environment, service, requestId)
 	switch service.Image.(type) {
 	case string:
 		if m.Client == nil {
 			return nil, false
 		}
 		if len(os.Getenv("SELENOID_KUBERNETES_ENABLED")) > 0 {
+			if getEgressPolicy(service, caps).Enforced() {
+				log.Printf("[%d] [EGRESS_POLICY_NOT_SUPPORTED] [%s] [%s]", requestId, browserName, version)
+				return nil, false
+			}
+			if caps.Network != nil {
+				log.Printf("[%d] [NETWORK_EMULATION_NOT_SUPPORTED] [%s] [%s]", requestId, browserName, version)
+				return nil, false
+			}
+			if service.SessionNetwork || caps.SessionNetwork || len(caps.Sidecars) > 0 {
+				log.Printf("[%d] [SESSION_NETWORK_NOT_SUPPORTED] [%s] [%s]", requestId, browserName, version)
+				return nil, false
+			}
 			log.Printf("[%d] [USING_KUBERNETES] [%s] [%s]", requestId, browserName, version)
 			inClusterConfig, err := rest.InClusterConfig()
 			if err != nil {
@@ -98,55 +226,154 @@ func (m *DefaultManager) Find(caps session.Caps, requestId uint64) (Starter, boo
 
 			return &Kubernetes{
 				ServiceBase:      serviceBase,
-				Environment:      *m.Environment,
+				Environment:      env,
 				Caps:             caps,
 				Client:           inClusterConfig,
 				BrowserNamespace: browserNamespace}, true
 		} else {
 			log.Printf("[%d] [USING_DOCKER] [%s] [%s]", requestId, browserName, version)
+			logConfig := m.Config.ContainerLogs
+			if service.LogConfig != nil {
+				logConfig = service.LogConfig
+			}
 			return &Docker{
 				ServiceBase: serviceBase,
-				Environment: *m.Environment,
+				Environment: env,
 				Caps:        caps,
-				Client:      m.Client,
-				LogConfig:   m.Config.ContainerLogs}, true
+				Client:      m.client(),
+				Hosts:       m.Hosts,
+				Health:      m.Health,
+				LogConfig:   logConfig}, true
 		}
 	case []interface{}:
+		if getEgressPolicy(service, caps).Enforced() {
+			log.Printf("[%d] [EGRESS_POLICY_NOT_SUPPORTED] [%s] [%s]", requestId, browserName, version)
+			return nil, false
+		}
+		if caps.Network != nil {
+			log.Printf("[%d] [NETWORK_EMULATION_NOT_SUPPORTED] [%s] [%s]", requestId, browserName, version)
+			return nil, false
+		}
+		if service.SessionNetwork || caps.SessionNetwork || len(caps.Sidecars) > 0 {
+			log.Printf("[%d] [SESSION_NETWORK_NOT_SUPPORTED] [%s] [%s]", requestId, browserName, version)
+			return nil, false
+		}
 		log.Printf("[%d] [USING_DRIVER] [%s] [%s]", requestId, browserName, version)
-		return &Driver{ServiceBase: serviceBase, Environment: *m.Environment, Caps: caps}, true
+		return &Driver{ServiceBase: serviceBase, Environment: env, Caps: caps}, true
 	}
 	return nil, false
 }
 
-func wait(u string, t time.Duration) error {
-	up := make(chan struct{})
-	done := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			default:
-			}
-			req, _ := http.NewRequest(http.MethodHead, u, nil)
-			req.Close = true
-			resp, err := http.DefaultClient.Do(req)
-			if resp != nil {
-				_ = resp.Body.Close()
-			}
-			if err != nil {
-				<-time.After(50 * time.Millisecond)
-				continue
-			}
-			up <- struct{}{}
-			return
+// CheckCustomImage - whether image requested with capability can replace configured one
+func CheckCustomImage(service *config.Browser, image interface{}, browserName, version, customImage string) error {
+	if _, ok := image.(string); !ok || !service.AllowsImage(customImage) {
+		return fmt.Errorf("image %s is not allowed for %s %s", customImage, browserName, version)
+	}
+	return nil
+}
+
+func areSidecarsAllowed(service *config.Browser, image interface{}, sidecars []session.Sidecar) bool {
+	if _, ok := image.(string); !ok {
+		return false
+	}
+	for _, sidecar := range sidecars {
+		if !service.AllowsSidecar(sidecar.Image) {
+			return false
+		}
+	}
+	return true
+}
+
+func getEgressPolicy(service *config.Browser, caps session.Caps) *egress.Policy {
+	return egress.Intersect(service.Egress, caps.Egress)
+}
+
+func browserEnvironment(env Environment, service *config.Browser, requestId uint64) Environment {
+	if service.StartupTimeout != "" {
+		startupTimeout, err := time.ParseDuration(service.StartupTimeout)
+		if err != nil {
+			log.Printf("[%d] [BAD_STARTUP_TIMEOUT] [%s] [%v]", requestId, service.StartupTimeout, err)
+		} else {
+			env.StartupTimeout = startupTimeout
+		}
+	}
+	if service.AttemptTimeout != "" {
+		attemptTimeout, err := time.ParseDuration(service.AttemptTimeout)
+		if err != nil {
+			log.Printf("[%d] [BAD_SESSION_ATTEMPT_TIMEOUT] [%s] [%v]", requestId, service.AttemptTimeout, err)
+		} else {
+			env.AttemptTimeout = attemptTimeout
+		}
+	}
+	if service.RetryCount > 0 {
+		env.RetryCount = service.RetryCount
+	}
+	return env
+}
+
+const (
+	minReadinessDelay = 50 * time.Millisecond
+	maxReadinessDelay = 1 * time.Second
+)
+
+func wait(u string, t time.Duration, readiness *config.Readiness) error {
+	deadline := time.Now().Add(t)
+	delay := minReadinessDelay
+	for {
+		err := checkReadiness(u, time.Until(deadline), readiness)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("%s is not ready in %v: %v", u, t, err)
+		}
+		<-time.After(delay)
+		delay *= 2
+		if delay > maxReadinessDelay {
+			delay = maxReadinessDelay
+		}
+	}
+}
+
+func checkReadiness(u string, t time.Duration, readiness *config.Readiness) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	defer cancel()
+	if readiness == nil {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		return nil
+	}
+	if readiness.Path != "" {
+		u = strings.TrimSuffix(u, "/") + "/" + strings.TrimPrefix(readiness.Path, "/")
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	req.Close = true
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if readiness.Status != 0 && resp.StatusCode != readiness.Status {
+		return fmt.Errorf("%s returned status %d instead of %d", u, resp.StatusCode, readiness.Status)
+	}
+	if readiness.Ready {
+		var status struct {
+			Value struct {
+				Ready bool `json:"ready"`
+			} `json:"value"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		if err != nil {
+			return fmt.Errorf("%s returned invalid status: %v", u, err)
+		}
+		if !status.Value.Ready {
+			return fmt.Errorf("%s returned value.ready = false", u)
 		}
-	}()
-	select {
-	case <-time.After(t):
-		close(done)
-		return fmt.Errorf("%s does not respond in %v", u, t)
-	case <-up:
 	}
 	return nil
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -9,6 +11,9 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,16 +22,46 @@ import (
 	"github.com/aerokube/selenoid/service"
 	"github.com/aerokube/selenoid/session"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
 	assert "github.com/stretchr/testify/require"
 	"golang.org/x/net/websocket"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
 )
 
 var (
 	mockServer *httptest.Server
 	lock       sync.Mutex
+
+	createdContainers []createContainerRequest
+	createdLock       sync.Mutex
+
+	createdPods []corev1.Pod
+
+	networkRequests []string
+	execCommands    []container.ExecOptions
+
+	removedImages []string
+
+	dockerServerVersion = "1.29"
+	dockerDown          bool
 )
 
+type createContainerRequest struct {
+	container.Config
+	HostConfig       container.HostConfig
+	NetworkingConfig network.NetworkingConfig
+}
+
+func lastCreatedContainer() createContainerRequest {
+	createdLock.Lock()
+	defer createdLock.Unlock()
+	return createdContainers[len(createdContainers)-1]
+}
+
 func init() {
 	updateMux(testMux())
 	timeout = 2 * time.Second
@@ -42,6 +77,7 @@ func updateMux(mux http.Handler) {
 	_ = os.Setenv("DOCKER_HOST", "tcp://"+hostPort(mockServer.URL))
 	_ = os.Setenv("DOCKER_API_VERSION", "1.29")
 	cli, _ = client.NewClientWithOpts(client.FromEnv)
+	dockerHealth = service.NewDockerHealth(cli, nil)
 }
 
 func testMux() http.Handler {
@@ -54,9 +90,25 @@ func testMux() http.Handler {
 		},
 	))
 
+	mux.HandleFunc("/wd/hub/status", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"value": {"ready": true}}`))
+		},
+	))
+	mux.HandleFunc("/wd/hub/starting", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"value": {"ready": false}}`))
+		},
+	))
+
 	//Docker API mock
 	mux.HandleFunc("/v1.29/containers/create", http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			var req createContainerRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			createdLock.Lock()
+			createdContainers = append(createdContainers, req)
+			createdLock.Unlock()
 			w.WriteHeader(http.StatusCreated)
 			output := `{"id": "e90e34656806", "warnings": []}`
 			_, _ = w.Write([]byte(output))
@@ -155,7 +207,7 @@ func testMux() http.Handler {
 					}
 				}			
 			  },
-			  "State": {},
+			  "State": {"Running": true, "Status": "running"},
 			  "Mounts": []
 			}
 			`, p, p, p, p, p, p)
@@ -167,6 +219,116 @@ func testMux() http.Handler {
 			w.WriteHeader(http.StatusOK)
 		},
 	))
+	mux.HandleFunc("/v1.29/networks/", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			createdLock.Lock()
+			networkRequests = append(networkRequests, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/v1.29/networks/"))
+			createdLock.Unlock()
+			if strings.HasSuffix(r.URL.Path, "/create") {
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte(`{"Id": "f4a5b6c7d8e9"}`))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	mux.HandleFunc("/v1.29/containers/e90e34656806/exec", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var exec container.ExecOptions
+			_ = json.NewDecoder(r.Body).Decode(&exec)
+			createdLock.Lock()
+			execCommands = append(execCommands, exec)
+			createdLock.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"Id": "a1b2c3d4e5f6"}`))
+		},
+	))
+	mux.HandleFunc("/v1.29/exec/a1b2c3d4e5f6/start", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	mux.HandleFunc("/v1.29/exec/a1b2c3d4e5f6/json", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"ID": "a1b2c3d4e5f6", "Running": false, "ExitCode": 0}`))
+		},
+	))
+	mux.HandleFunc("/v1.29/containers/e90e34656806/stats", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			output := `{"read": "2024-01-01T00:00:00Z", "cpu_stats": {"cpu_usage": {"total_usage": 100}, "system_cpu_usage": 1000, "online_cpus": 2}, "memory_stats": {"usage": 300, "stats": {"inactive_file": 100}}, "networks": {"eth0": {"rx_bytes": 1000, "tx_bytes": 500}}}
+{"read": "2024-01-01T00:00:01Z", "cpu_stats": {"cpu_usage": {"total_usage": 300}, "system_cpu_usage": 2000, "online_cpus": 2}, "precpu_stats": {"cpu_usage": {"total_usage": 100}, "system_cpu_usage": 1000, "online_cpus": 2}, "memory_stats": {"usage": 500, "stats": {"inactive_file": 100}}, "networks": {"eth0": {"rx_bytes": 3000, "tx_bytes": 1500}}, "blkio_stats": {"io_service_bytes_recursive": [{"op": "Read", "value": 4096}, {"op": "Write", "value": 8192}]}}
+{"read": "2024-01-01T00:00:02Z", "cpu_stats": {"cpu_usage": {"total_usage": 350}, "system_cpu_usage": 3000, "online_cpus": 2}, "precpu_stats": {"cpu_usage": {"total_usage": 300}, "system_cpu_usage": 2000, "online_cpus": 2}, "memory_stats": {"usage": 200}, "networks": {"eth0": {"rx_bytes": 3000, "tx_bytes": 1500}}, "blkio_stats": {"io_service_bytes_recursive": [{"op": "Read", "value": 4096}, {"op": "Write", "value": 8192}]}}
+`
+			_, _ = w.Write([]byte(output))
+		},
+	))
+	mux.HandleFunc("/v1.29/events", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			output := `{"Type": "container", "Action": "die", "Actor": {"ID": "a0b1c2d3e4f5", "Attributes": {"exitCode": "0"}}, "timeNano": 1000}
+{"Type": "container", "Action": "oom", "Actor": {"ID": "e90e34656806"}, "timeNano": 2000}
+{"Type": "container", "Action": "die", "Actor": {"ID": "e90e34656806", "Attributes": {"exitCode": "137"}}, "timeNano": 3000}
+`
+			_, _ = w.Write([]byte(output))
+		},
+	))
+	mux.HandleFunc("/v1.29/images/json", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			old := time.Now().Add(-30 * 24 * time.Hour).Unix()
+			output := fmt.Sprintf(`[
+				{"Id": "sha256:1", "RepoTags": ["selenoid/firefox:33.0"], "Created": %d},
+				{"Id": "sha256:2", "RepoTags": ["selenoid/chrome:50.0", "selenoid/chrome:latest"], "Created": %d},
+				{"Id": "sha256:3", "RepoTags": ["selenoid/chrome:51.0"], "Created": %d},
+				{"Id": "sha256:4", "RepoTags": ["other/image:1.0"], "Created": %d},
+				{"Id": "sha256:5", "RepoTags": ["selenoid/video-recorder:latest-release"], "Created": %d},
+				{"Id": "sha256:6", "RepoTags": ["<none>:<none>"], "Created": %d},
+				{"Id": "sha256:7", "RepoTags": ["selenoid/chrome:48.0"], "RepoDigests": ["selenoid/chrome@sha256:abc"], "Created": %d},
+				{"Id": "sha256:8", "RepoTags": ["selenoid/opera:60.0"], "RepoDigests": ["selenoid/opera@sha256:def"], "Created": %d}
+			]`, old, old, time.Now().Unix(), old, old, old, old, old)
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(output))
+		},
+	))
+	mux.HandleFunc("/v1.29/images/", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodDelete {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			createdLock.Lock()
+			removedImages = append(removedImages, strings.TrimPrefix(r.URL.Path, "/v1.29/images/"))
+			createdLock.Unlock()
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`[]`))
+		},
+	))
+	mux.HandleFunc("/_ping", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			createdLock.Lock()
+			defer createdLock.Unlock()
+			if dockerDown {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Api-Version", dockerServerVersion)
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	mux.HandleFunc("/v1.29/info", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"Architecture": "aarch64"}`))
+		},
+	))
+	mux.HandleFunc("/v1.29/images/selenoid/firefox:33.0/json", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			output := `{"Id": "sha256:0123456789abcdef", "RepoDigests": ["selenoid/firefox@sha256:fedcba9876543210"]}`
+			_, _ = w.Write([]byte(output))
+		},
+	))
 	return mux
 }
 
@@ -266,6 +428,7 @@ func testDocker(t *testing.T, env *service.Environment, cfg *config.Config) {
 	assert.NotNil(t, startedService.Url)
 	assert.NotNil(t, startedService.Container)
 	assert.Equal(t, startedService.Container.ID, "e90e34656806")
+	assert.Equal(t, startedService.Container.Image, "selenoid/firefox:33.0")
 	assert.Equal(t, startedService.HostPort.VNC, "127.0.0.1:5900")
 	assert.NotNil(t, startedService.Cancel)
 	startedService.Cancel()
@@ -337,6 +500,373 @@ func TestDeleteContainerOnStartupError(t *testing.T) {
 	assert.Equal(t, numDeleteRequests, 1)
 }
 
+func TestImageDigestMatches(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].Digest = "sha256:fedcba9876543210"
+	testDocker(t, env, cfg)
+}
+
+func TestImageDigestMismatch(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].Digest = "sha256:1111111111111111"
+	starter := createDockerStarter(t, env, cfg)
+	_, err := starter.StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match digest")
+}
+
+func TestFindImageForArchitecture(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].Image = map[string]interface{}{
+		"amd64": "selenoid/firefox:33.0-amd64",
+		"arm64": "selenoid/firefox:33.0-arm64",
+	}
+	starter := createDockerStarter(t, env, cfg)
+	docker, ok := starter.(*service.Docker)
+	assert.True(t, ok)
+	assert.Equal(t, docker.Service.Image, "selenoid/firefox:33.0-arm64")
+	assert.IsType(t, map[string]interface{}{}, cfg.Browsers["firefox"].Versions["33.0"].Image)
+}
+
+func TestFindImageForMissingArchitecture(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].Image = map[string]interface{}{
+		"amd64": "selenoid/firefox:33.0-amd64",
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+	_, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.False(t, ok)
+}
+
+func TestFindBrowserTimeouts(t *testing.T) {
+	env := testEnvironment()
+	env.AttemptTimeout = 30 * time.Second
+	env.RetryCount = 1
+	cfg := testConfig(env)
+	browser := cfg.Browsers["firefox"].Versions["33.0"]
+	browser.StartupTimeout = "2m"
+	browser.AttemptTimeout = "1m"
+	browser.RetryCount = 3
+	starter := createDockerStarter(t, env, cfg)
+	docker, ok := starter.(*service.Docker)
+	assert.True(t, ok)
+	assert.Equal(t, docker.StartupTimeout, 2*time.Minute)
+	assert.Equal(t, docker.AttemptTimeout, 1*time.Minute)
+	assert.Equal(t, docker.RetryCount, 3)
+	assert.Equal(t, env.StartupTimeout, serviceStartupTimeout)
+}
+
+func TestBrowserReadiness(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	browser := cfg.Browsers["firefox"].Versions["33.0"]
+	browser.Path = "/wd/hub"
+	browser.Readiness = &config.Readiness{Path: "/status", Status: http.StatusOK, Ready: true, HealthCheck: true}
+	starter := createDockerStarter(t, env, cfg)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	startedService.Cancel()
+
+	browser.Readiness = &config.Readiness{Path: "/starting", Ready: true}
+	env.StartupTimeout = 300 * time.Millisecond
+	starter = createDockerStarter(t, env, cfg)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "value.ready = false")
+
+	browser.Readiness = &config.Readiness{Path: "/missing", Status: http.StatusOK}
+	starter = createDockerStarter(t, env, cfg)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "returned status 404 instead of 200")
+}
+
+func TestFindCustomImage(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].AllowedImages = []string{`^registry\.example\.com/selenoid/firefox:.+$`}
+	assert.NoError(t, cfg.Browsers["firefox"].Versions["33.0"].Compile())
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0", Image: "registry.example.com/selenoid/firefox:33.0-rc1"}, 42)
+	assert.True(t, ok)
+	assert.Equal(t, starter.(*service.Docker).Service.Image, "registry.example.com/selenoid/firefox:33.0-rc1")
+	assert.Equal(t, cfg.Browsers["firefox"].Versions["33.0"].Image, "selenoid/firefox:33.0")
+
+	_, ok = manager.Find(session.Caps{Name: "firefox", Version: "33.0", Image: "evil.example.com/selenoid/firefox:33.0"}, 42)
+	assert.False(t, ok)
+}
+
+func TestFindCustomImageNotConfigured(t *testing.T) {
+	env := testEnvironment()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: testConfig(env)}
+	_, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0", Image: "selenoid/firefox:33.0"}, 42)
+	assert.False(t, ok)
+}
+
+func TestRequestedResources(t *testing.T) {
+	env := testEnvironment()
+	env.InDocker = true
+	cfg := testConfig(env)
+	browser := cfg.Browsers["firefox"].Versions["33.0"]
+	browser.MaxMem = "2g"
+	browser.MaxCpu = "2.0"
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	testResources := func(mem, cpu string, expectedMem, expectedCpu int64) {
+		starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0", Mem: mem, Cpu: cpu}, 42)
+		assert.True(t, ok)
+		startedService, err := starter.StartWithCancel()
+		assert.NoError(t, err)
+		defer startedService.Cancel()
+		resources := lastCreatedContainer().HostConfig.Resources
+		assert.Equal(t, resources.Memory, expectedMem)
+		assert.Equal(t, resources.NanoCPUs, expectedCpu)
+	}
+	testResources("", "", 512*1024*1024, 1000000000)
+	testResources("1g", "1.5", 1024*1024*1024, 1500000000)
+	testResources("4g", "4.0", 2*1024*1024*1024, 2000000000)
+
+	browser.Mem, browser.MaxMem = "", ""
+	browser.Cpu, browser.MaxCpu = "", ""
+	testResources("64g", "64.0", 0, 0)
+}
+
+func TestCheckRequestedResources(t *testing.T) {
+	assert.NoError(t, service.CheckRequestedResources(session.Caps{}))
+	assert.NoError(t, service.CheckRequestedResources(session.Caps{Mem: "1g", Cpu: "0.5"}))
+	assert.Error(t, service.CheckRequestedResources(session.Caps{Mem: "0"}))
+	assert.Error(t, service.CheckRequestedResources(session.Caps{Mem: "lots"}))
+	assert.Error(t, service.CheckRequestedResources(session.Caps{Cpu: "-1.0"}))
+	assert.Error(t, service.CheckRequestedResources(session.Caps{Cpu: "0"}))
+}
+
+func TestExtendedHostSettings(t *testing.T) {
+	env := testEnvironment()
+	env.InDocker = true
+	cfg := testConfig(env)
+	browser := cfg.Browsers["firefox"].Versions["33.0"]
+	init := true
+	browser.CapAdd = []string{"NET_ADMIN"}
+	browser.CapDrop = []string{"MKNOD"}
+	browser.SecurityOpt = []string{"no-new-privileges"}
+	browser.Ulimits = []string{"nofile=1024:2048"}
+	browser.Devices = []string{"/dev/kvm", "/dev/snd:/dev/sound:rw"}
+	browser.User = "selenium"
+	browser.ReadOnlyRootfs = true
+	browser.Init = &init
+	browser.Runtime = "runsc"
+	browser.GroupAdd = []string{"audio"}
+	browser.LogConfig = &container.LogConfig{Type: "json-file", Config: map[string]string{"max-size": "10m"}}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0", TestName: "my-test"}, 42)
+	assert.True(t, ok)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	defer startedService.Cancel()
+	created := lastCreatedContainer()
+	hostConfig := created.HostConfig
+	assert.Equal(t, created.User, "selenium")
+	assert.Equal(t, []string(hostConfig.CapAdd), []string{"SYS_ADMIN", "NET_ADMIN"})
+	assert.Equal(t, []string(hostConfig.CapDrop), []string{"MKNOD"})
+	assert.Equal(t, hostConfig.SecurityOpt, []string{"no-new-privileges"})
+	assert.Len(t, hostConfig.Ulimits, 1)
+	assert.Equal(t, *hostConfig.Ulimits[0], units.Ulimit{Name: "nofile", Soft: 1024, Hard: 2048})
+	assert.Equal(t, hostConfig.Devices, []container.DeviceMapping{
+		{PathOnHost: "/dev/kvm", PathInContainer: "/dev/kvm", CgroupPermissions: "rwm"},
+		{PathOnHost: "/dev/snd", PathInContainer: "/dev/sound", CgroupPermissions: "rw"},
+	})
+	assert.True(t, hostConfig.ReadonlyRootfs)
+	assert.True(t, *hostConfig.Init)
+	assert.Equal(t, hostConfig.Runtime, "runsc")
+	assert.Equal(t, hostConfig.GroupAdd, []string{"audio"})
+	assert.Equal(t, hostConfig.LogConfig.Type, "json-file")
+	assert.Equal(t, hostConfig.LogConfig.Config, map[string]string{"max-size": "10m", "tag": "my-test"})
+	assert.Equal(t, browser.LogConfig.Config, map[string]string{"max-size": "10m"})
+}
+
+func TestBadDeviceSpecification(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].Devices = []string{"/dev/kvm:/dev/kvm:bad"}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+}
+
+func TestSessionNetwork(t *testing.T) {
+	env := testEnvironment()
+	env.InDocker = true
+	env.Network = "selenoid"
+	env.Hostname = "selenoid-host"
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+	createdLock.Lock()
+	networkRequests = nil
+	createdLock.Unlock()
+
+	caps := session.Caps{Name: "firefox", Version: "33.0", SessionNetwork: true, ApplicationContainers: []string{"backend:api"}}
+	starter, ok := manager.Find(caps, 42)
+	assert.True(t, ok)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	networkName := string(lastCreatedContainer().HostConfig.NetworkMode)
+	assert.True(t, strings.HasPrefix(networkName, "selenoid-"))
+	startedService.Cancel()
+
+	createdLock.Lock()
+	defer createdLock.Unlock()
+	assert.Equal(t, networkRequests, []string{
+		"POST create",
+		fmt.Sprintf("POST %s/connect", networkName),
+		fmt.Sprintf("POST %s/connect", networkName),
+		fmt.Sprintf("POST %s/disconnect", networkName),
+		fmt.Sprintf("POST %s/disconnect", networkName),
+		"DELETE " + networkName,
+	})
+}
+
+func TestSidecars(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["firefox"].Versions["33.0"].AllowedSidecars = []string{"^wiremock/wiremock:.+$"}
+	assert.NoError(t, cfg.Browsers["firefox"].Versions["33.0"].Compile())
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	sidecar := session.Sidecar{Image: "wiremock/wiremock:3.3.1", Env: []string{"PORT=8080"}, Aliases: []string{"backend"}}
+	caps := session.Caps{Name: "firefox", Version: "33.0", Sidecars: []session.Sidecar{sidecar}}
+	starter, ok := manager.Find(caps, 42)
+	assert.True(t, ok)
+	mem, cpu, err := starter.(service.Consumer).Resources()
+	assert.NoError(t, err)
+	assert.Equal(t, mem, int64(2*512*1024*1024))
+	assert.Equal(t, cpu, int64(2*1000000000))
+	createdLock.Lock()
+	createdContainers = nil
+	createdLock.Unlock()
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	defer startedService.Cancel()
+
+	createdLock.Lock()
+	defer createdLock.Unlock()
+	assert.Len(t, createdContainers, 2)
+	sidecarContainer, browserContainer := createdContainers[0], createdContainers[1]
+	networkName := string(browserContainer.HostConfig.NetworkMode)
+	assert.True(t, strings.HasPrefix(networkName, "selenoid-"))
+	assert.Equal(t, sidecarContainer.Image, "wiremock/wiremock:3.3.1")
+	assert.Equal(t, sidecarContainer.Env, []string{"PORT=8080"})
+	assert.Equal(t, string(sidecarContainer.HostConfig.NetworkMode), networkName)
+	assert.Equal(t, sidecarContainer.NetworkingConfig.EndpointsConfig[networkName].Aliases, []string{"backend"})
+	assert.Equal(t, sidecarContainer.HostConfig.Memory, browserContainer.HostConfig.Memory)
+	assert.Equal(t, sidecarContainer.HostConfig.NanoCPUs, browserContainer.HostConfig.NanoCPUs)
+	assert.NotZero(t, sidecarContainer.HostConfig.Memory)
+
+	caps.Sidecars = []session.Sidecar{{Image: "evil/image"}}
+	_, ok = manager.Find(caps, 42)
+	assert.False(t, ok)
+}
+
+func TestNetworkEmulation(t *testing.T) {
+	env := testEnvironment()
+	env.Privileged = false
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+	createdLock.Lock()
+	execCommands = nil
+	createdLock.Unlock()
+
+	caps := session.Caps{Name: "firefox", Version: "33.0", Network: &session.Network{Latency: 100, Jitter: 10, Loss: 1.5, Bandwidth: 1000}}
+	starter, ok := manager.Find(caps, 42)
+	assert.True(t, ok)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	defer startedService.Cancel()
+	assert.Contains(t, []string(lastCreatedContainer().HostConfig.CapAdd), "NET_ADMIN")
+	assert.NotNil(t, startedService.Network)
+	assert.NoError(t, startedService.Network(&session.Network{}))
+
+	createdLock.Lock()
+	defer createdLock.Unlock()
+	assert.Len(t, execCommands, 2)
+	assert.Contains(t, execCommands[0].Cmd[2], "tc qdisc replace dev \"$dev\" root netem delay 100ms 10ms loss 1.5% rate 1000kbit")
+	assert.Contains(t, execCommands[1].Cmd[2], "tc qdisc del dev \"$dev\" root")
+	assert.False(t, execCommands[0].Privileged)
+}
+
+func TestNetworkEmulationFailure(t *testing.T) {
+	inspected := 0
+	mux := http.NewServeMux()
+	mux.Handle("/", testMux())
+	mux.HandleFunc("/v1.29/exec/a1b2c3d4e5f6/json", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			inspected++
+			w.WriteHeader(http.StatusOK)
+			if inspected == 1 {
+				_, _ = w.Write([]byte(`{"ID": "a1b2c3d4e5f6", "Running": true, "ExitCode": 0}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"ID": "a1b2c3d4e5f6", "Running": false, "ExitCode": 2}`))
+		},
+	))
+	updateMux(mux)
+	defer updateMux(testMux())
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0", Network: &session.Network{Latency: 100}}, 42)
+	assert.True(t, ok)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tc exited with code 2")
+	assert.Equal(t, inspected, 2)
+}
+
+func TestNoNetworkEmulation(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	defer startedService.Cancel()
+	assert.Nil(t, startedService.Network)
+	assert.NotContains(t, []string(lastCreatedContainer().HostConfig.CapAdd), "NET_ADMIN")
+}
+
 func TestFindDriver(t *testing.T) {
 	env := testEnvironment()
 	manager := service.DefaultManager{Environment: env, Config: testConfig(env)}
@@ -348,6 +878,15 @@ func TestFindDriver(t *testing.T) {
 	starter, success := manager.Find(caps, 42)
 	assert.True(t, success)
 	assert.NotNil(t, starter)
+
+	caps.Network = &session.Network{}
+	_, success = manager.Find(caps, 42)
+	assert.False(t, success)
+
+	caps.Network = nil
+	caps.SessionNetwork = true
+	_, success = manager.Find(caps, 42)
+	assert.False(t, success)
 }
 
 func TestGetVNC(t *testing.T) {
@@ -410,3 +949,599 @@ func TestGetLogs(t *testing.T) {
 	u := fmt.Sprintf("ws://%s/logs/test-session", hostPort(srv.URL))
 	assert.Equal(t, readDataFromWebSocket(t, u), "test-data")
 }
+
+func TestWatchContainers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var exits []service.ContainerExit
+	service.WatchContainers(ctx, func() *client.Client { return cli }, func(exit service.ContainerExit) {
+		exits = append(exits, exit)
+		if exit.ID == "e90e34656806" {
+			cancel()
+		}
+	})
+	assert.Equal(t, exits, []service.ContainerExit{
+		{ID: "a0b1c2d3e4f5", ExitCode: 0},
+		{ID: "e90e34656806", ExitCode: 137, OOMKilled: true},
+	})
+}
+
+func TestWatchContainersReconnect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.29/events", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"Type": "container", "Action": "die", "Actor": {"ID": "a0b1c2d3e4f5", "Attributes": {"exitCode": "0"}}, "timeNano": 1000}` + "\n"))
+		},
+	))
+	updateMux(mux)
+	defer updateMux(testMux())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connects := 0
+	exits := 0
+	service.WatchContainers(ctx, func() *client.Client {
+		connects++
+		return cli
+	}, func(exit service.ContainerExit) {
+		exits++
+		if exits == 2 {
+			cancel()
+		}
+	})
+	assert.Equal(t, exits, 2)
+	assert.Equal(t, connects, 2)
+}
+
+func TestContainerStats(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	manager := service.DefaultManager{Environment: env, Client: cli, Config: cfg}
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	defer startedService.Cancel()
+	assert.Eventually(t, func() bool {
+		stats := startedService.Usage.Stats()
+		return stats != nil && stats.Samples == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, startedService.Usage.Stats(), &session.Stats{
+		Samples: 2,
+		Current: session.Usage{CPU: 10, Memory: 200},
+		Peak:    session.Usage{CPU: 40, Memory: 400, NetworkRx: 2000, NetworkTx: 1000, BlockRead: 4096, BlockWrite: 8192},
+		Average: session.Usage{CPU: 25, Memory: 300, NetworkRx: 1000, NetworkTx: 500, BlockRead: 2048, BlockWrite: 4096},
+	})
+}
+
+func TestDockerHosts(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	hosts := service.NewHosts(
+		&service.DockerHost{Name: "first", IP: "127.0.0.1", Capacity: 1, Client: cli},
+		&service.DockerHost{Name: "second", IP: "127.0.0.1", Capacity: 2, Client: cli},
+	)
+	manager := service.DefaultManager{Environment: env, Client: cli, Hosts: hosts, Config: cfg}
+
+	var placed []string
+	var started []*service.StartedService
+	for i := 0; i < 3; i++ {
+		starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+		assert.True(t, ok)
+		startedService, err := starter.StartWithCancel()
+		assert.NoError(t, err)
+		placed = append(placed, startedService.Container.Host)
+		started = append(started, startedService)
+	}
+	assert.Equal(t, placed, []string{"first", "second", "second"})
+	assert.Equal(t, hosts.State(), []config.HostState{
+		{Name: "first", IP: "127.0.0.1", Capacity: 1, Used: 1, Healthy: true},
+		{Name: "second", IP: "127.0.0.1", Capacity: 2, Used: 2, Healthy: true},
+	})
+
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+
+	for _, startedService := range started {
+		startedService.Cancel()
+	}
+	for _, state := range hosts.State() {
+		assert.Equal(t, state.Used, 0)
+	}
+}
+
+func TestDockerHostsInsideOfDocker(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/", testMux())
+	mux.HandleFunc("/v1.29/containers/e90e34656806/json", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"Id": "e90e34656806", "NetworkSettings": {"Ports": {"4444/tcp": null}}, "State": {"Running": true, "Status": "running"}}`))
+		},
+	))
+	updateMux(mux)
+	defer updateMux(testMux())
+
+	env := testEnvironment()
+	env.InDocker = true
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	hosts := service.NewHosts(&service.DockerHost{Name: "remote", IP: "10.0.0.1", Capacity: 1, Client: cli})
+	manager := service.DefaultManager{Environment: env, Client: cli, Hosts: hosts, Config: cfg}
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no bindings available")
+	assert.NotEmpty(t, lastCreatedContainer().HostConfig.PortBindings)
+	assert.Equal(t, hosts.State()[0].Used, 0)
+}
+
+func TestVideoOnRemoteDockerHost(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	hosts := service.NewHosts(&service.DockerHost{Name: "remote", IP: "10.0.0.1", Capacity: 1, Client: cli})
+	manager := service.DefaultManager{Environment: env, Client: cli, Hosts: hosts, Config: cfg}
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0", Video: true}, 42)
+	assert.True(t, ok)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "video recording is not supported on remote Docker host remote")
+	assert.False(t, service.IsStartupFailure(err))
+	assert.Equal(t, hosts.State()[0].Used, 0)
+
+	hosts = service.NewHosts(&service.DockerHost{Name: "local", IP: "127.0.0.1", Capacity: 1, Client: cli, Local: true})
+	manager = service.DefaultManager{Environment: env, Client: cli, Hosts: hosts, Config: cfg}
+	starter, ok = manager.Find(session.Caps{Name: "firefox", Version: "33.0", Video: true}, 42)
+	assert.True(t, ok)
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	startedService.Cancel()
+}
+
+func TestCheckEgressNetwork(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.29/networks/internal", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"Name": "internal", "Internal": true}`))
+		},
+	))
+	mux.HandleFunc("/v1.29/networks/bridge", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"Name": "bridge", "Internal": false}`))
+		},
+	))
+	updateMux(mux)
+	defer updateMux(testMux())
+
+	ctx := context.Background()
+	assert.NoError(t, service.CheckEgressNetwork(ctx, cli, "internal"))
+	err := service.CheckEgressNetwork(ctx, cli, "bridge")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not internal")
+	assert.Error(t, service.CheckEgressNetwork(ctx, cli, "missing"))
+}
+
+func TestLoadDockerHosts(t *testing.T) {
+	hostsFile := configfile(`[{"name": "first", "host": "tcp://10.0.0.1:2375", "capacity": 5}, {"host": "tcp://10.0.0.2:2375", "ip": "192.168.0.2", "capacity": 3}]`)
+	defer os.Remove(hostsFile)
+	hosts, err := service.LoadHosts(hostsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, hosts.State(), []config.HostState{
+		{Name: "first", IP: "10.0.0.1", Capacity: 5, Healthy: true},
+		{Name: "tcp://10.0.0.2:2375", IP: "192.168.0.2", Capacity: 3, Healthy: true},
+	})
+	_, ok := hosts.Client("first")
+	assert.True(t, ok)
+
+	badHostsFile := configfile(`[{"name": "first", "host": "tcp://10.0.0.1:2375"}]`)
+	defer os.Remove(badHostsFile)
+	_, err = service.LoadHosts(badHostsFile)
+	assert.Error(t, err)
+}
+
+func setDockerState(version string, down bool) {
+	createdLock.Lock()
+	defer createdLock.Unlock()
+	dockerServerVersion, dockerDown = version, down
+}
+
+func TestDockerHealth(t *testing.T) {
+	defer setDockerState("1.29", false)
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	assert.NoError(t, err)
+	connects := 0
+	health := service.NewDockerHealth(cli, func() (*client.Client, error) {
+		connects++
+		return client.NewClientWithOpts(client.FromEnv)
+	})
+	env := testEnvironment()
+	manager := service.DefaultManager{Environment: env, Client: cli, Health: health, Config: testConfig(env)}
+
+	health.Check(context.Background(), time.Second)
+	assert.True(t, health.State().Healthy)
+	assert.Equal(t, health.State().APIVersion, "1.29")
+	assert.NoError(t, health.Err())
+
+	setDockerState("1.29", true)
+	health.Check(context.Background(), time.Second)
+	assert.False(t, health.State().Healthy)
+	assert.Error(t, health.Err())
+	starter, ok := manager.Find(session.Caps{Name: "firefox", Version: "33.0"}, 42)
+	assert.True(t, ok)
+	_, err = starter.StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "docker daemon is not available")
+
+	setDockerState("1.29", false)
+	health.Check(context.Background(), time.Second)
+	assert.True(t, health.State().Healthy)
+	assert.Equal(t, connects, 1)
+	assert.NotSame(t, health.Client(), cli)
+
+	setDockerState("1.30", false)
+	health.Check(context.Background(), time.Second)
+	assert.Equal(t, health.State().APIVersion, "1.30")
+	assert.Equal(t, connects, 2)
+
+	health.Check(context.Background(), time.Second)
+	assert.Equal(t, connects, 2)
+}
+
+func TestImageCollector(t *testing.T) {
+	env := testEnvironment()
+	cfg := testConfig(env)
+	cfg.Browsers["chrome"] = config.Versions{
+		Default: "48.0",
+		Versions: map[string]*config.Browser{
+			"48.0": {Image: "selenoid/chrome@sha256:abc"},
+		},
+	}
+	cfg.Browsers["opera"] = config.Versions{
+		Default: "60.0",
+		Versions: map[string]*config.Browser{
+			"60.0": {Image: "selenoid/opera:latest", Digest: "sha256:def"},
+		},
+	}
+	collector := &service.ImageCollector{
+		Config:  cfg,
+		Pattern: regexp.MustCompile("^selenoid/"),
+		MaxAge:  7 * 24 * time.Hour,
+		DryRun:  true,
+		InUse: func() []string {
+			return []string{"selenoid/video-recorder:latest-release", "selenoid/chrome"}
+		},
+	}
+	createdLock.Lock()
+	removedImages = nil
+	createdLock.Unlock()
+
+	collector.Collect(context.Background(), cli)
+	createdLock.Lock()
+	assert.Empty(t, removedImages)
+	createdLock.Unlock()
+
+	collector.DryRun = false
+	collector.Collect(context.Background(), cli)
+	createdLock.Lock()
+	defer createdLock.Unlock()
+	assert.Equal(t, removedImages, []string{"selenoid/chrome:50.0"})
+}
+
+func kubernetesMux(status corev1.PodStatus, deleted *[]string) http.Handler {
+	var created corev1.Pod
+	var podLock sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/selenoid/pods", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			podLock.Lock()
+			defer podLock.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPost {
+				_ = json.NewDecoder(r.Body).Decode(&created)
+				created.TypeMeta = metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}
+				created.UID = "8c4b9d2e"
+				created.ResourceVersion = "1"
+				createdLock.Lock()
+				createdPods = append(createdPods, created)
+				createdLock.Unlock()
+				w.WriteHeader(http.StatusCreated)
+				_ = json.NewEncoder(w).Encode(created)
+				return
+			}
+			pod := created
+			pod.ResourceVersion = "2"
+			pod.Status = status
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"type": "MODIFIED", "object": pod})
+		},
+	))
+	mux.HandleFunc("/api/v1/namespaces/selenoid/services", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var svc corev1.Service
+			_ = json.NewDecoder(r.Body).Decode(&svc)
+			svc.TypeMeta = metav1.TypeMeta{Kind: "Service", APIVersion: "v1"}
+			svc.Spec.ClusterIP = "10.96.0.42"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(svc)
+		},
+	))
+	objectHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/log") {
+				_, _ = w.Write([]byte("browser log line\n"))
+				return
+			}
+			if r.Method == http.MethodDelete {
+				*deleted = append(*deleted, strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/selenoid/"))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Success"}`))
+		},
+	)
+	mux.Handle("/api/v1/namespaces/selenoid/pods/", objectHandler)
+	mux.Handle("/api/v1/namespaces/selenoid/services/", objectHandler)
+	mux.HandleFunc("/api/v1/namespaces/selenoid/events", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"kind": "EventList", "apiVersion": "v1", "items": [
+				{"type": "Normal", "reason": "Scheduled", "message": "Successfully assigned pod to node-1"},
+				{"type": "Warning", "reason": "Failed", "message": "Failed to pull image \"selenoid/chrome:missing\": not found"}
+			]}`))
+		},
+	))
+	return mux
+}
+
+func createKubernetesStarter(u string, timeout time.Duration) *service.Kubernetes {
+	return createKubernetesStarterWithCaps(u, timeout, session.Caps{})
+}
+
+func createKubernetesStarterWithCaps(u string, timeout time.Duration, caps session.Caps) *service.Kubernetes {
+	return &service.Kubernetes{
+		ServiceBase: service.ServiceBase{
+			RequestId: 42,
+			Service:   &config.Browser{Image: "selenoid/chrome:missing", Path: "/"},
+		},
+		Environment:      service.Environment{StartupTimeout: timeout},
+		Client:           &rest.Config{Host: u, ContentConfig: rest.ContentConfig{ContentType: "application/json"}},
+		Caps:             caps,
+		BrowserNamespace: "selenoid",
+	}
+}
+
+func TestKubernetesPodStartupFailure(t *testing.T) {
+	var deleted []string
+	status := corev1.PodStatus{
+		Phase: corev1.PodPending,
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "browser", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}}},
+		},
+	}
+	srv := httptest.NewServer(kubernetesMux(status, &deleted))
+	defer srv.Close()
+
+	_, err := createKubernetesStarter(srv.URL, 5*time.Second).StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "container browser is in ImagePullBackOff state")
+	assert.Contains(t, err.Error(), "Failed to pull image")
+	assert.NotContains(t, err.Error(), "Successfully assigned")
+	assert.Len(t, deleted, 1)
+	assert.True(t, strings.HasPrefix(deleted[0], "pods/browser-"))
+}
+
+func TestKubernetesPodStartupTimeout(t *testing.T) {
+	var deleted []string
+	status := corev1.PodStatus{
+		Phase: corev1.PodPending,
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable", Message: "0/3 nodes are available: 3 Insufficient memory."},
+		},
+	}
+	srv := httptest.NewServer(kubernetesMux(status, &deleted))
+	defer srv.Close()
+
+	_, err := createKubernetesStarter(srv.URL, 300*time.Millisecond).StartWithCancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not ready in 300ms")
+	assert.Contains(t, err.Error(), "PodScheduled: Unschedulable 0/3 nodes are available")
+	assert.Len(t, deleted, 1)
+}
+
+func TestKubernetesPodStarted(t *testing.T) {
+	var deleted []string
+	status := corev1.PodStatus{
+		Phase: corev1.PodRunning,
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		},
+	}
+	srv := httptest.NewServer(kubernetesMux(status, &deleted))
+	defer srv.Close()
+
+	startedService, err := createKubernetesStarterWithCaps(srv.URL, 5*time.Second, session.Caps{VNC: true}).StartWithCancel()
+	assert.NoError(t, err)
+	hostname := startedService.Url.Hostname()
+	assert.True(t, strings.HasPrefix(hostname, "browser-"))
+	assert.True(t, strings.HasSuffix(hostname, ".selenoid.svc.cluster.local"))
+	name := strings.TrimSuffix(hostname, ".selenoid.svc.cluster.local")
+	assert.Equal(t, startedService.HostPort.Selenium, net.JoinHostPort(hostname, "4444"))
+	assert.Equal(t, startedService.HostPort.VNC, net.JoinHostPort(hostname, "5900"))
+	assert.Equal(t, startedService.HostPort.Devtools, net.JoinHostPort(hostname, "7070"))
+	assert.Equal(t, startedService.HostPort.Fileserver, net.JoinHostPort(hostname, "8080"))
+	assert.Equal(t, startedService.HostPort.Clipboard, net.JoinHostPort(hostname, "9090"))
+	assert.Equal(t, startedService.Container.IPAddress, "10.96.0.42")
+
+	r, err := startedService.Logs(context.Background())
+	assert.NoError(t, err)
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "browser log line\n")
+	_ = r.Close()
+
+	startedService.Cancel()
+	assert.Equal(t, deleted, []string{"pods/" + name, "services/" + name})
+}
+
+func TestKubernetesPodWatchExpired(t *testing.T) {
+	var deleted []string
+	var watches, gets int
+	var lock sync.Mutex
+	pods := kubernetesMux(corev1.PodStatus{Phase: corev1.PodPending}, &deleted)
+	mux := http.NewServeMux()
+	mux.Handle("/", pods)
+	mux.HandleFunc("/api/v1/namespaces/selenoid/pods", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				pods.ServeHTTP(w, r)
+				return
+			}
+			lock.Lock()
+			watches++
+			lock.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"type": "ERROR", "object": {"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Expired", "code": 410}}`))
+		},
+	))
+	mux.HandleFunc("/api/v1/namespaces/selenoid/pods/", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || strings.HasSuffix(r.URL.Path, "/log") {
+				pods.ServeHTTP(w, r)
+				return
+			}
+			lock.Lock()
+			gets++
+			lock.Unlock()
+			pod := corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: path.Base(r.URL.Path), ResourceVersion: "3"},
+				Status: corev1.PodStatus{
+					Phase:      corev1.PodRunning,
+					Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+				},
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(pod)
+		},
+	))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	startedService, err := createKubernetesStarter(srv.URL, 5*time.Second).StartWithCancel()
+	assert.NoError(t, err)
+	startedService.Cancel()
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, watches, 1)
+	assert.Equal(t, gets, 1)
+}
+
+func TestKubernetesPodWithoutVNC(t *testing.T) {
+	var deleted []string
+	status := corev1.PodStatus{
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		},
+	}
+	srv := httptest.NewServer(kubernetesMux(status, &deleted))
+	defer srv.Close()
+
+	startedService, err := createKubernetesStarter(srv.URL, 5*time.Second).StartWithCancel()
+	assert.NoError(t, err)
+	assert.Empty(t, startedService.HostPort.VNC)
+	assert.NotEmpty(t, startedService.HostPort.Devtools)
+}
+
+func TestKubernetesVideoRecorder(t *testing.T) {
+	var deleted []string
+	status := corev1.PodStatus{
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		},
+	}
+	srv := httptest.NewServer(kubernetesMux(status, &deleted))
+	defer srv.Close()
+
+	caps := session.Caps{Video: true, VideoName: "video.mp4", VideoScreenSize: "1024x768", VideoFrameRate: 12, Env: []string{"SECRET=value"}}
+	starter := createKubernetesStarterWithCaps(srv.URL, 5*time.Second, caps)
+	starter.Service.Env = []string{"LANG=ru_RU.UTF-8"}
+	starter.VideoContainerImage = "selenoid/video-recorder:latest-release"
+	starter.VideoOutputDir = t.TempDir()
+	starter.SessionDeleteTimeout = time.Second
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+
+	createdLock.Lock()
+	pod := createdPods[len(createdPods)-1]
+	createdLock.Unlock()
+	assert.Equal(t, pod.Spec.RestartPolicy, corev1.RestartPolicyNever)
+	assert.Len(t, pod.Spec.Containers, 2)
+	browser, recorder := pod.Spec.Containers[0], pod.Spec.Containers[1]
+	assert.Contains(t, browser.VolumeMounts, corev1.VolumeMount{Name: "video", MountPath: "/video"})
+	assert.Equal(t, recorder.Name, "video-recorder")
+	assert.Equal(t, recorder.Image, "selenoid/video-recorder:latest-release")
+	assert.Equal(t, recorder.VolumeMounts, []corev1.VolumeMount{{Name: "video", MountPath: "/data"}})
+	assert.Subset(t, recorder.Env, []corev1.EnvVar{
+		{Name: "FILE_NAME", Value: "video.mp4"},
+		{Name: "BROWSER_CONTAINER_NAME", Value: "localhost"},
+		{Name: "VIDEO_SIZE", Value: "1024x768"},
+		{Name: "FRAME_RATE", Value: "12"},
+	})
+	for _, env := range recorder.Env {
+		assert.NotContains(t, []string{"SECRET", "LANG", "SCREEN_RESOLUTION", "ENABLE_VNC"}, env.Name)
+	}
+	assert.Contains(t, browser.Env, corev1.EnvVar{Name: "SECRET", Value: "value"})
+
+	startedService.Cancel()
+	assert.Len(t, deleted, 2)
+}
+
+func TestKubernetesVideoRecorderWithPodTemplate(t *testing.T) {
+	var deleted []string
+	status := corev1.PodStatus{
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		},
+	}
+	srv := httptest.NewServer(kubernetesMux(status, &deleted))
+	defer srv.Close()
+
+	caps := session.Caps{Video: true, VideoName: "video.mp4"}
+	starter := createKubernetesStarterWithCaps(srv.URL, 5*time.Second, caps)
+	starter.Service.PodTemplate = &corev1.Pod{
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyOnFailure,
+			Volumes:       []corev1.Volume{{Name: "certs"}},
+			Containers: []corev1.Container{
+				{Name: "browser", Image: "selenoid/chrome:custom"},
+			},
+		},
+	}
+	starter.VideoContainerImage = "selenoid/video-recorder:latest-release"
+	starter.VideoOutputDir = t.TempDir()
+	starter.SessionDeleteTimeout = time.Second
+	startedService, err := starter.StartWithCancel()
+	assert.NoError(t, err)
+	defer startedService.Cancel()
+
+	createdLock.Lock()
+	pod := createdPods[len(createdPods)-1]
+	createdLock.Unlock()
+	assert.Equal(t, pod.Spec.RestartPolicy, corev1.RestartPolicyOnFailure)
+	assert.Len(t, pod.Spec.Volumes, 2)
+	assert.Equal(t, pod.Spec.Volumes[1].Name, "video")
+	assert.Len(t, pod.Spec.Containers, 2)
+	browser, recorder := pod.Spec.Containers[0], pod.Spec.Containers[1]
+	assert.Equal(t, browser.Image, "selenoid/chrome:custom")
+	assert.Contains(t, browser.VolumeMounts, corev1.VolumeMount{Name: "video", MountPath: "/video"})
+	assert.Equal(t, recorder.Name, "video-recorder")
+}
@@ -1,10 +1,16 @@
 package session
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/url"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/aerokube/selenoid/egress"
 	"github.com/imdario/mergo"
 )
 
@@ -38,9 +44,46 @@ type Caps struct {
 	Labels                map[string]string `json:"labels,omitempty"`
 	SessionTimeout        string            `json:"sessionTimeout,omitempty"`
 	S3KeyPattern          string            `json:"s3KeyPattern,omitempty"`
+	Image                 string            `json:"image,omitempty"`
+	Mem                   string            `json:"mem,omitempty"`
+	Cpu                   string            `json:"cpu,omitempty"`
+	SessionNetwork        bool              `json:"sessionNetwork,omitempty"`
+	Sidecars              []Sidecar         `json:"sidecars,omitempty"`
+	Network               *Network          `json:"network,omitempty"`
+	Egress                *egress.Policy    `json:"-"`
 	ExtensionCapabilities *Caps             `json:"selenoid:options,omitempty"`
 }
 
+// Sidecar - application container started together with browser
+type Sidecar struct {
+	Image   string   `json:"image"`
+	Env     []string `json:"env,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// Network - emulated network conditions, latency and jitter are in milliseconds,
+// bandwidth in kbit/s and loss in percent
+type Network struct {
+	Latency   int     `json:"latency,omitempty"`
+	Jitter    int     `json:"jitter,omitempty"`
+	Bandwidth int     `json:"bandwidth,omitempty"`
+	Loss      float64 `json:"loss,omitempty"`
+}
+
+// Validate - check that network conditions are in allowed ranges
+func (n *Network) Validate() error {
+	if n == nil {
+		return nil
+	}
+	if n.Latency < 0 || n.Jitter < 0 || n.Bandwidth < 0 {
+		return fmt.Errorf("network latency, jitter and bandwidth can not be negative")
+	}
+	if n.Loss < 0 || n.Loss > 100 {
+		return fmt.Errorf("network loss should be from 0 to 100 percent: %v", n.Loss)
+	}
+	return nil
+}
+
 func (c *Caps) ProcessExtensionCapabilities() {
 	if c.W3CVersion != "" {
 		c.Version = c.W3CVersion
@@ -57,6 +100,131 @@ func (c *Caps) ProcessExtensionCapabilities() {
 	}
 }
 
+// WithCapabilities - capabilities with default values added where requested ones are missing and forced values replaced
+func (c Caps) WithCapabilities(requested, defaults, forced map[string]interface{}) (Caps, error) {
+	if len(defaults) == 0 && len(forced) == 0 {
+		return c, nil
+	}
+	c.ExtensionCapabilities = nil
+	data, err := json.Marshal(c)
+	if err != nil {
+		return c, fmt.Errorf("marshal capabilities: %v", err)
+	}
+	m := make(map[string]interface{})
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return c, fmt.Errorf("unmarshal capabilities: %v", err)
+	}
+	MergeCapabilities(m, missingCapabilities(flattenExtensionCapabilities(requested), flattenExtensionCapabilities(defaults)), false)
+	MergeCapabilities(m, flattenExtensionCapabilities(forced), true)
+	data, err = json.Marshal(m)
+	if err != nil {
+		return c, fmt.Errorf("marshal capabilities: %v", err)
+	}
+	var ret Caps
+	err = json.Unmarshal(data, &ret)
+	if err != nil {
+		return c, fmt.Errorf("invalid capabilities: %v", err)
+	}
+	ret.ProcessExtensionCapabilities()
+	return ret, nil
+}
+
+func flattenExtensionCapabilities(caps map[string]interface{}) map[string]interface{} {
+	const selenoidOptions = "selenoid:options"
+	ret := make(map[string]interface{})
+	for k, v := range caps {
+		if k != selenoidOptions {
+			ret[k] = v
+		}
+	}
+	if ext, ok := caps[selenoidOptions].(map[string]interface{}); ok {
+		for k, v := range ext {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// Marshalled capabilities omit explicit false and empty values, so gaps are looked for in requested ones
+func missingCapabilities(requested, defaults map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for k, v := range defaults {
+		existing, ok := requested[k]
+		if !ok {
+			ret[k] = v
+			continue
+		}
+		if em, ok := existing.(map[string]interface{}); ok {
+			if dm, ok := v.(map[string]interface{}); ok {
+				if missing := missingCapabilities(em, dm); len(missing) > 0 {
+					ret[k] = missing
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// MergeCapabilities - recursively merge src capabilities into dst,
+// when force is set src values replace existing ones and lists are joined
+func MergeCapabilities(dst, src map[string]interface{}, force bool) {
+	for k, v := range src {
+		existing, ok := dst[k]
+		if !ok {
+			dst[k] = copyValue(v)
+			continue
+		}
+		if em, ok := existing.(map[string]interface{}); ok {
+			if sm, ok := v.(map[string]interface{}); ok {
+				MergeCapabilities(em, sm, force)
+				continue
+			}
+		}
+		if !force {
+			continue
+		}
+		if el, ok := existing.([]interface{}); ok {
+			if sl, ok := v.([]interface{}); ok {
+				dst[k] = appendMissing(el, sl)
+				continue
+			}
+		}
+		dst[k] = copyValue(v)
+	}
+}
+
+func appendMissing(dst, src []interface{}) []interface{} {
+loop:
+	for _, v := range src {
+		for _, e := range dst {
+			if reflect.DeepEqual(e, v) {
+				continue loop
+			}
+		}
+		dst = append(dst, copyValue(v))
+	}
+	return dst
+}
+
+func copyValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{})
+		for k, v := range value {
+			ret[k] = copyValue(v)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(value))
+		for i, v := range value {
+			ret[i] = copyValue(v)
+		}
+		return ret
+	}
+	return v
+}
+
 func (c *Caps) BrowserName() string {
 	browserName := c.Name
 	if browserName != "" {
@@ -72,6 +240,8 @@ func (c *Caps) BrowserName() string {
 type Container struct {
 	ID        string            `json:"id"`
 	IPAddress string            `json:"ip"`
+	Image     string            `json:"image,omitempty"`
+	Host      string            `json:"host,omitempty"`
 	Ports     map[string]string `json:"exposedPorts,omitempty"`
 }
 
@@ -84,6 +254,9 @@ type Session struct {
 	HostPort  HostPort
 	Origin    string
 	Cancel    func()
+	Network   func(network *Network) error
+	Usage     *UsageRecorder
+	Logs      func(ctx context.Context) (io.ReadCloser, error)
 	Timeout   time.Duration
 	TimeoutCh chan struct{}
 	Started   time.Time
@@ -154,4 +327,5 @@ type Metadata struct {
 	Capabilities Caps      `json:"capabilities"`
 	Started      time.Time `json:"started"`
 	Finished     time.Time `json:"finished"`
+	Stats        *Stats    `json:"stats,omitempty"`
 }
@@ -0,0 +1,84 @@
+package session
+
+import "sync"
+
+// Usage - resource usage sample: CPU in percent of one core, memory in bytes,
+// network and block I/O in bytes per second
+type Usage struct {
+	CPU        float64 `json:"cpu"`
+	Memory     uint64  `json:"memory"`
+	NetworkRx  uint64  `json:"networkRx"`
+	NetworkTx  uint64  `json:"networkTx"`
+	BlockRead  uint64  `json:"blockRead"`
+	BlockWrite uint64  `json:"blockWrite"`
+}
+
+// Stats - current, peak and average resource usage of session container
+type Stats struct {
+	Samples int   `json:"samples"`
+	Current Usage `json:"current"`
+	Peak    Usage `json:"peak"`
+	Average Usage `json:"average"`
+}
+
+// UsageRecorder - accumulates resource usage samples
+type UsageRecorder struct {
+	lock    sync.RWMutex
+	samples int
+	current Usage
+	peak    Usage
+	cpu     float64
+	memory  float64
+	netRx   float64
+	netTx   float64
+	blkRead float64
+	blkWrt  float64
+}
+
+// Add - record usage sample
+func (r *UsageRecorder) Add(u Usage) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.samples++
+	r.current = u
+	r.peak = Usage{
+		CPU:        max(r.peak.CPU, u.CPU),
+		Memory:     max(r.peak.Memory, u.Memory),
+		NetworkRx:  max(r.peak.NetworkRx, u.NetworkRx),
+		NetworkTx:  max(r.peak.NetworkTx, u.NetworkTx),
+		BlockRead:  max(r.peak.BlockRead, u.BlockRead),
+		BlockWrite: max(r.peak.BlockWrite, u.BlockWrite),
+	}
+	r.cpu += u.CPU
+	r.memory += float64(u.Memory)
+	r.netRx += float64(u.NetworkRx)
+	r.netTx += float64(u.NetworkTx)
+	r.blkRead += float64(u.BlockRead)
+	r.blkWrt += float64(u.BlockWrite)
+}
+
+// Stats - get recorded statistics, nil when nothing was recorded
+func (r *UsageRecorder) Stats() *Stats {
+	if r == nil {
+		return nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.samples == 0 {
+		return nil
+	}
+	n := float64(r.samples)
+	return &Stats{
+		Samples: r.samples,
+		Current: r.current,
+		Peak:    r.peak,
+		Average: Usage{
+			CPU:        r.cpu / n,
+			Memory:     uint64(r.memory / n),
+			NetworkRx:  uint64(r.netRx / n),
+			NetworkTx:  uint64(r.netTx / n),
+			BlockRead:  uint64(r.blkRead / n),
+			BlockWrite: uint64(r.blkWrt / n),
+		},
+	}
+}
@@ -24,9 +24,11 @@ import (
 )
 
 type HTTPTest struct {
-	Handler http.Handler
-	Action  func(s *httptest.Server)
-	Cancel  chan bool
+	Handler        http.Handler
+	Action         func(s *httptest.Server)
+	Cancel         chan bool
+	AttemptTimeout time.Duration
+	RetryCount     int
 }
 
 func HTTPResponse(msg string, status int) http.Handler {
@@ -48,7 +50,9 @@ func (m *HTTPTest) StartWithCancel() (*service.StartedService, error) {
 		m.Action(s)
 	}
 	ss := service.StartedService{
-		Url: u,
+		Url:            u,
+		AttemptTimeout: m.AttemptTimeout,
+		RetryCount:     m.RetryCount,
 		HostPort: session.HostPort{
 			Fileserver: u.Host,
 			Clipboard:  u.Host,
@@ -78,13 +82,78 @@ type StartupError struct{}
 func (m *StartupError) StartWithCancel() (*service.StartedService, error) {
 	log.Println("Starting StartupError Service...")
 	log.Println("Failed to start StartupError Service...")
-	return nil, errors.New("failed to start Service")
+	return nil, &service.StartupFailure{Err: errors.New("failed to start Service")}
 }
 
 func (m *StartupError) Find(caps session.Caps, requestId uint64) (service.Starter, bool) {
 	return m, true
 }
 
+type RequestError struct{}
+
+func (m *RequestError) StartWithCancel() (*service.StartedService, error) {
+	return nil, errors.New("invalid memory limit")
+}
+
+func (m *RequestError) Find(caps session.Caps, requestId uint64) (service.Starter, bool) {
+	return m, true
+}
+
+type FlakyStartup struct {
+	HTTPTest
+	Failures  int
+	Attempts  int
+	Permanent bool
+}
+
+func (m *FlakyStartup) StartWithCancel() (*service.StartedService, error) {
+	m.Attempts++
+	if m.Attempts <= m.Failures {
+		return nil, &service.StartupFailure{Err: errors.New("failed to start Service"), Transient: !m.Permanent}
+	}
+	return m.HTTPTest.StartWithCancel()
+}
+
+func (m *FlakyStartup) Find(caps session.Caps, requestId uint64) (service.Starter, bool) {
+	return m, true
+}
+
+type FallbackTest struct {
+	HTTPTest
+	BrokenVersion string
+	Fallback      []string
+}
+
+type brokenVersion struct {
+	StartupError
+	fallback []string
+}
+
+func (m *brokenVersion) FallbackVersions() []string {
+	return m.fallback
+}
+
+func (m *FallbackTest) Find(caps session.Caps, requestId uint64) (service.Starter, bool) {
+	if caps.Version == m.BrokenVersion {
+		return &brokenVersion{fallback: m.Fallback}, true
+	}
+	return &m.HTTPTest, true
+}
+
+type ConsumerTest struct {
+	HTTPTest
+	Mem int64
+	CPU int64
+}
+
+func (m *ConsumerTest) Resources() (int64, int64, error) {
+	return m.Mem, m.CPU, nil
+}
+
+func (m *ConsumerTest) Find(caps session.Caps, requestId uint64) (service.Starter, bool) {
+	return m, true
+}
+
 type BrowserNotFound struct{}
 
 func (m *BrowserNotFound) Find(caps session.Caps, requestId uint64) (service.Starter, bool) {
@@ -258,6 +327,122 @@ func TestSumUsedTotalGreaterThanPending(t *testing.T) {
 	assert.Equal(t, queue.Used(), 2)
 }
 
+func TestBudgetReserve(t *testing.T) {
+	budget := protect.NewBudget(protect.Resources{Mem: 4, CPU: 2})
+	assert.NoError(t, budget.Reserve(context.Background(), protect.Resources{Mem: 3, CPU: 1}))
+	assert.Equal(t, budget.State().Free, protect.Resources{Mem: 1, CPU: 1})
+
+	assert.Error(t, budget.Reserve(context.Background(), protect.Resources{Mem: 5}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, budget.Reserve(ctx, protect.Resources{Mem: 2, CPU: 1}))
+
+	reserved := make(chan error)
+	go func() {
+		reserved <- budget.Reserve(context.Background(), protect.Resources{Mem: 2, CPU: 1})
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("resources should not be reserved before release")
+	case <-time.After(10 * time.Millisecond):
+	}
+	budget.Release(protect.Resources{Mem: 3, CPU: 1})
+	assert.NoError(t, <-reserved)
+	assert.Equal(t, budget.State().Used, protect.Resources{Mem: 2, CPU: 1})
+}
+
+func TestBudgetTryReserveAndShare(t *testing.T) {
+	budget := protect.NewBudget(protect.Resources{Mem: 4, CPU: 2})
+	assert.True(t, budget.TryReserve(protect.Resources{Mem: 3, CPU: 1}))
+	assert.False(t, budget.TryReserve(protect.Resources{Mem: 2}))
+	assert.Equal(t, budget.State().Used, protect.Resources{Mem: 3, CPU: 1})
+	assert.Equal(t, budget.Share(2), protect.Resources{Mem: 2, CPU: 1})
+	assert.Equal(t, budget.Share(0), protect.Resources{})
+}
+
+func TestQueueYield(t *testing.T) {
+	queue := protect.New(1, false)
+	hf := func(_ http.ResponseWriter, _ *http.Request) {}
+	srv := httptest.NewServer(queue.Protect(hf))
+	defer srv.Close()
+
+	_, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, queue.Pending(), 1)
+	queue.Yield()
+	assert.Equal(t, queue.Pending(), 0)
+	assert.Equal(t, queue.Queued(), 1)
+
+	_, err = http.Get(srv.URL)
+	assert.NoError(t, err)
+	queue.Create()
+	resumed := make(chan struct{})
+	go func() {
+		queue.Resume()
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("slot should not be resumed while taken")
+	case <-time.After(10 * time.Millisecond):
+	}
+	queue.Release()
+	<-resumed
+	assert.Equal(t, queue.Pending(), 1)
+	assert.Equal(t, queue.Queued(), 0)
+}
+
+func TestUnlimitedBudget(t *testing.T) {
+	var budget *protect.Budget
+	assert.NoError(t, budget.Reserve(context.Background(), protect.Resources{Mem: 1}))
+	assert.Nil(t, budget.State())
+
+	budget = protect.NewBudget(protect.Resources{CPU: 1})
+	assert.NoError(t, budget.Reserve(context.Background(), protect.Resources{Mem: 1 << 40, CPU: 1}))
+	assert.Equal(t, budget.State().Free, protect.Resources{})
+}
+
+func TestBreaker(t *testing.T) {
+	breaker := protect.NewBreaker(2, 20*time.Millisecond)
+	assert.False(t, breaker.Failure("firefox", "33.0"))
+	_, err := breaker.Allow("firefox", "33.0")
+	assert.NoError(t, err)
+	assert.True(t, breaker.Failure("firefox", "33.0"))
+	_, err = breaker.Allow("firefox", "33.0")
+	assert.Error(t, err)
+	_, err = breaker.Allow("firefox", "34.0")
+	assert.NoError(t, err)
+	assert.Len(t, breaker.State(), 1)
+
+	time.Sleep(30 * time.Millisecond)
+	probe, err := breaker.Allow("firefox", "33.0")
+	assert.NoError(t, err)
+	assert.True(t, probe)
+	_, err = breaker.Allow("firefox", "33.0")
+	assert.Error(t, err)
+	assert.True(t, breaker.State()[0].Probing)
+	assert.True(t, breaker.Failure("firefox", "33.0"))
+	_, err = breaker.Allow("firefox", "33.0")
+	assert.Error(t, err)
+
+	time.Sleep(30 * time.Millisecond)
+	probe, err = breaker.Allow("firefox", "33.0")
+	assert.NoError(t, err)
+	assert.True(t, probe)
+	assert.True(t, breaker.Success("firefox", "33.0"))
+	assert.Empty(t, breaker.State())
+}
+
+func TestDisabledBreaker(t *testing.T) {
+	var breaker *protect.Breaker
+	probe, err := breaker.Allow("firefox", "33.0")
+	assert.NoError(t, err)
+	assert.False(t, probe)
+	assert.False(t, breaker.Failure("firefox", "33.0"))
+	assert.Nil(t, breaker.State())
+}
+
 func TestBrowserName(t *testing.T) {
 	var caps session.Caps
 